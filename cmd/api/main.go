@@ -1,28 +1,72 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/jralph/hackernews-api/internal/server"
 	"github.com/jralph/hackernews-api/pkg/storage"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func main() {
-	redisHost := flag.String("redis-host", "127.0.0.1:6379", "set the redis host in format of <host>:<port>")
+	storeDSN := flag.String("store", "redis://127.0.0.1:6379", "set the store to use as a dsn, such as redis://[:password@]host:port[/db][?pool_size=10&dial_timeout=5s], rediss:// for redis over tls, redis+sentinel://host1,host2?master=name, redis+cluster://host1,host2, memory:// or file:///path/to/hackernews.db")
+	staleFor := flag.Duration("stale-for", 0, "set how long expired responses may be served while they are regenerated in the background")
+	cacheSize := flag.Int("cache-size", 10000, "set how many responses the memory and file stores cache in process, or 0 for no limit")
 
 	flag.Parse()
 
-	store := storage.NewRedisStore(
-		storage.WithRedisOptions(&redis.Options{
-			Addr: *redisHost,
-		}),
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
 	)
 
-	svr := server.CreateServer(
-		server.WithStorage(store),
+	store, err := storage.Open(
+		*storeDSN,
+		storage.WithMetrics(registry),
+		storage.WithStaleWhileRevalidate(*staleFor),
+		storage.WithCacheSize(*cacheSize),
 	)
+	if err != nil {
+		panic(fmt.Errorf("api: error opening store: %s", err))
+	}
+	defer store.Close()
 
-	http.ListenAndServe(":8901", svr)
+	svr := &http.Server{
+		Addr: ":8901",
+		Handler: server.CreateServer(
+			server.WithStorage(store),
+			server.WithMetrics(registry),
+		),
+	}
+
+	shutdown := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		defer close(shutdown)
+		<-signals
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		err := svr.Shutdown(ctx)
+		if err != nil {
+			fmt.Printf("api: error shutting down server: %s\n", err)
+		}
+	}()
+
+	err = svr.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		panic(fmt.Errorf("api: error running server: %s", err))
+	}
+
+	<-shutdown
 }
@@ -1,37 +1,214 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/jralph/hackernews-api/internal/scraper"
+	"github.com/jralph/hackernews-api/internal/server"
 	"github.com/jralph/hackernews-api/pkg/hnclient"
 	"github.com/jralph/hackernews-api/pkg/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/robfig/cron/v3"
 )
 
+// migrator is implemented by stores with data from older versions to upgrade.
+type migrator interface {
+	Migrate(context.Context) (int, error)
+}
+
 func main() {
-	redisHost := flag.String("redis-host", "127.0.0.1:6379", "set the redis host in format of <host>:<port>")
+	storeDSN := flag.String("store", "redis://127.0.0.1:6379", "set the store to use as a dsn, such as redis://[:password@]host:port[/db][?pool_size=10&dial_timeout=5s], rediss:// for redis over tls, redis+sentinel://host1,host2?master=name, redis+cluster://host1,host2, memory:// or file:///path/to/hackernews.db")
 	workers := flag.Int("workers", 100, "set the number of works to run when scraping content")
+	users := flag.Bool("users", false, "set whether to scrape the profiles of item authors")
+	incremental := flag.Bool("incremental", false, "set whether to only scrape new and updated items since the last scrape")
+	feedNames := flag.String("feeds", "top", "set the comma separated feeds to scrape, any of top,new,best,ask,show,job")
+	interval := flag.Duration("interval", 0, "set to run as a daemon, scraping on the given interval such as 5m")
+	cronSpec := flag.String("cron", "", "set to run as a daemon, scraping on the given cron expression such as \"*/5 * * * *\"")
+	jitter := flag.Duration("jitter", 0, "set the maximum random delay added to each scheduled scrape when running as a daemon")
+	maxAttempts := flag.Int("max-attempts", hnclient.DefaultRetryPolicy.MaxAttempts, "set the maximum attempts for requests failing with network errors, 429 or 5xx responses")
+	retryDelay := flag.Duration("retry-delay", hnclient.DefaultRetryPolicy.BaseDelay, "set the initial delay between retried requests, doubling on each attempt")
+	rateLimit := flag.Float64("rate", 50, "set the maximum average requests per second made to the hacker news api, 0 to disable")
+	burst := flag.Int("burst", 10, "set the maximum burst of requests allowed above the rate limit, at least 1 when rate is set")
+	maxInFlight := flag.Int("max-in-flight", 20, "set the maximum concurrent requests made to the hacker news api, 0 to disable")
+	gracePeriod := flag.Duration("grace-period", scraper.DefaultGracePeriod, "set how long an in-flight scrape may run after shutdown is requested when running as a daemon, or 0 to cancel it immediately")
+	snapshots := flag.Bool("snapshots", false, "set whether to stage each scrape and publish it at once when it completes, keeping the previous data for rollback")
+	rollback := flag.Bool("rollback", false, "set to restore the data replaced by the last published scrape and exit")
+	batchSize := flag.Int("batch-size", 100, "set the number of scraped items saved together in one round trip to the store, 1 to save every item as it is scraped")
+	batchInterval := flag.Duration("batch-interval", time.Second, "set the longest scraped items wait to be saved when fewer than batch-size are buffered")
+	metricsAddr := flag.String("metrics-addr", "", "set to serve prometheus metrics on the given address such as :9102")
+	apiAddr := flag.String("api-addr", "", "set to also serve the api on the given address such as :8901 when running as a daemon, sharing the store with the scraper, which a file store requires")
+	staleFor := flag.Duration("stale-for", 0, "set how long expired responses may be served while they are regenerated in the background when serving the api")
+	cacheSize := flag.Int("cache-size", 10000, "set how many responses the memory and file stores cache in process when serving the api, or 0 for no limit")
 
 	flag.Parse()
 
-	saver := storage.NewRedisStore(
-		storage.WithRedisOptions(&redis.Options{
-			Addr: *redisHost,
+	if *rateLimit > 0 && *burst < 1 {
+		panic(fmt.Errorf("scraper: -burst must be at least 1 when -rate is set"))
+	}
+
+	var feeds []scraper.Feed
+	for _, name := range strings.Split(*feedNames, ",") {
+		feed, err := scraper.ParseFeed(strings.TrimSpace(name))
+		if err != nil {
+			panic(err)
+		}
+		feeds = append(feeds, feed)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	if *apiAddr != "" && *interval == 0 && *cronSpec == "" {
+		panic(fmt.Errorf("scraper: -api-addr requires -interval or -cron"))
+	}
+
+	saver, err := storage.Open(
+		*storeDSN,
+		storage.WithMetrics(registry),
+		storage.WithStaleWhileRevalidate(*staleFor),
+		storage.WithCacheSize(*cacheSize),
+	)
+	if err != nil {
+		panic(fmt.Errorf("scraper: error opening store: %s", err))
+	}
+	defer saver.Close()
+	client := hnclient.NewClient(
+		hnclient.WithRetryPolicy(hnclient.RetryPolicy{
+			MaxAttempts: *maxAttempts,
+			BaseDelay:   *retryDelay,
+			MaxDelay:    hnclient.DefaultRetryPolicy.MaxDelay,
 		}),
+		hnclient.WithRateLimit(*rateLimit, *burst),
+		hnclient.WithMaxInFlight(*maxInFlight),
+		hnclient.WithMetrics(registry),
 	)
-	client := hnclient.NewClient()
 	s := scraper.NewScraper(
 		scraper.WithSaver(saver),
 		scraper.WithClient(client),
 		scraper.WithWorkerCount(*workers),
+		scraper.WithFeeds(feeds...),
+		scraper.WithUsers(*users),
+		scraper.WithSnapshots(*snapshots),
+		scraper.WithBatching(*batchSize, *batchInterval),
+		scraper.WithMetrics(registry),
 	)
 
-	items, err := s.Scrape()
+	scrape := s.Scrape
+	if *incremental {
+		scrape = s.ScrapeIncremental
+	}
+
+	var schedule scraper.Schedule
+	if *interval > 0 {
+		schedule = scraper.Interval(*interval)
+	}
+	if *cronSpec != "" {
+		cronSchedule, err := cron.ParseStandard(*cronSpec)
+		if err != nil {
+			panic(fmt.Errorf("scraper: error parsing cron expression: %s", err))
+		}
+		schedule = cronSchedule
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	if *metricsAddr != "" {
+		go func() {
+			err := http.ListenAndServe(*metricsAddr, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+			if err != nil {
+				fmt.Printf("scraper: error serving metrics: %s\n", err)
+			}
+		}()
+	}
+
+	if migrator, ok := saver.(migrator); ok {
+		migrated, err := migrator.Migrate(ctx)
+		if err != nil {
+			panic(fmt.Errorf("scraper: error migrating storage: %s", err))
+		}
+		if migrated > 0 {
+			fmt.Printf("scraper: migrated %d items to the current storage schema\n", migrated)
+		}
+	}
+
+	if *rollback {
+		err := saver.Rollback(ctx)
+		if err != nil {
+			panic(fmt.Errorf("scraper: error rolling back: %s", err))
+		}
+
+		fmt.Println("scraper: successfully rolled back to the previous scrape")
+		return
+	}
+
+	if schedule != nil {
+		if *apiAddr != "" {
+			stopAPI := serveAPI(*apiAddr, saver, registry)
+			defer stopAPI()
+		}
+
+		daemon := scraper.NewDaemon(
+			scrape,
+			scraper.WithSchedule(schedule),
+			scraper.WithJitter(*jitter),
+			scraper.WithGracePeriod(*gracePeriod),
+		)
+		daemon.Run(ctx)
+		return
+	}
+
+	items, err := scrape(ctx)
 	if err != nil {
 		panic(fmt.Errorf("scraper: error running scrape: %s", err))
 	}
 
 	fmt.Printf("scraper: successfully scraped %d items\n", items)
 }
+
+// serveAPI serves the api from store on addr until the returned func is
+// called, so that a store only one process can open is shared by the api and
+// the scraper.
+func serveAPI(addr string, store storage.Store, registry *prometheus.Registry) func() {
+	svr := &http.Server{
+		Addr: addr,
+		Handler: server.CreateServer(
+			server.WithStorage(store),
+			server.WithMetrics(registry),
+		),
+	}
+
+	go func() {
+		err := svr.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			panic(fmt.Errorf("scraper: error serving api: %s", err))
+		}
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		err := svr.Shutdown(ctx)
+		if err != nil {
+			fmt.Printf("scraper: error shutting down api: %s\n", err)
+		}
+	}
+}
@@ -3,8 +3,13 @@ module github.com/jralph/hackernews-api
 go 1.15
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.3
 	github.com/go-redis/redis/v8 v8.5.0
 	github.com/labstack/echo/v4 v4.1.17
 	github.com/mborders/artifex v0.4.0 // indirect
+	github.com/prometheus/client_golang v1.9.0
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/stretchr/testify v1.7.0
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324
 )
@@ -0,0 +1,198 @@
+package scraper
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ItemsSaver is implemented by savers able to save many items at once, such
+// as in a single round trip to the store.
+type ItemsSaver interface {
+	SaveItems(context.Context, []*ItemResponse) error
+}
+
+// batchSaver buffers saved items, writing them once size items are buffered
+// or every interval. Other writes go straight to the wrapped saver, except
+// deletes, the max item and the last scrape, which are only saved once every
+// buffered item has been so that they never get ahead of the items. Items
+// that fail to save are kept buffered and retried by the next flush.
+type batchSaver struct {
+	Saver
+	size int
+
+	mu    sync.Mutex
+	items []*ItemResponse
+	// err is the error of a background flush, reported by the next write.
+	err error
+
+	// flushMu runs flushes one at a time, so that once a flush returns every
+	// item buffered before it has been saved.
+	flushMu sync.Mutex
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newBatchSaver starts flushing the buffered items every interval until ctx is
+// cancelled or the batch saver is closed.
+func newBatchSaver(ctx context.Context, saver Saver, size int, interval time.Duration) *batchSaver {
+	ctx, cancel := context.WithCancel(ctx)
+	b := &batchSaver{
+		Saver:  saver,
+		size:   size,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go b.flushEvery(ctx, interval)
+
+	return b
+}
+
+func (b *batchSaver) flushEvery(ctx context.Context, interval time.Duration) {
+	defer close(b.done)
+
+	if interval <= 0 {
+		<-ctx.Done()
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := b.flush(ctx)
+			if err != nil && ctx.Err() == nil {
+				b.mu.Lock()
+				if b.err == nil {
+					b.err = err
+				}
+				b.mu.Unlock()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// SaveItem buffers item, saving the whole buffer once it is full.
+func (b *batchSaver) SaveItem(ctx context.Context, item *ItemResponse) error {
+	b.mu.Lock()
+	b.items = append(b.items, item)
+	full := len(b.items) >= b.size
+	b.mu.Unlock()
+
+	err := b.takeErr()
+	if err != nil {
+		return err
+	}
+
+	if !full {
+		return nil
+	}
+
+	return b.flush(ctx)
+}
+
+// DeleteItem saves the buffered items before deleting item, so that a
+// buffered copy of it cannot be saved over the delete.
+func (b *batchSaver) DeleteItem(ctx context.Context, item *ItemResponse) error {
+	err := b.Flush(ctx)
+	if err != nil {
+		return err
+	}
+
+	return b.Saver.DeleteItem(ctx, item)
+}
+
+func (b *batchSaver) SaveMaxItem(ctx context.Context, id int) error {
+	err := b.Flush(ctx)
+	if err != nil {
+		return err
+	}
+
+	return b.Saver.SaveMaxItem(ctx, id)
+}
+
+func (b *batchSaver) SaveLastScrape(ctx context.Context, at time.Time) error {
+	err := b.Flush(ctx)
+	if err != nil {
+		return err
+	}
+
+	return b.Saver.SaveLastScrape(ctx, at)
+}
+
+// Flush saves every buffered item, returning the error of any earlier
+// background flush that has not been reported yet.
+func (b *batchSaver) Flush(ctx context.Context) error {
+	err := b.flush(ctx)
+	if err != nil {
+		return err
+	}
+
+	return b.takeErr()
+}
+
+// Close stops the background flushes and saves whatever is still buffered.
+func (b *batchSaver) Close(ctx context.Context) error {
+	b.cancel()
+	<-b.done
+
+	return b.Flush(ctx)
+}
+
+func (b *batchSaver) flush(ctx context.Context) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	items := b.items
+	b.items = nil
+	b.mu.Unlock()
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	if saver, ok := b.Saver.(ItemsSaver); ok {
+		err := saver.SaveItems(ctx, items)
+		if err != nil {
+			b.requeue(items)
+		}
+
+		return err
+	}
+
+	for i, item := range items {
+		err := b.Saver.SaveItem(ctx, item)
+		if err != nil {
+			b.requeue(items[i:])
+			return err
+		}
+	}
+
+	return nil
+}
+
+// requeue puts items that failed to save back at the front of the buffer, so
+// they are retried before anything buffered since.
+func (b *batchSaver) requeue(items []*ItemResponse) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.items = append(items, b.items...)
+}
+
+func (b *batchSaver) takeErr() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := b.err
+	b.err = nil
+
+	return err
+}
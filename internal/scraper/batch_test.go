@@ -0,0 +1,164 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type MockItemsSaver struct {
+	MockSaver
+
+	mu      sync.Mutex
+	batches [][]int
+	err     error
+}
+
+func (m *MockItemsSaver) SaveItems(ctx context.Context, items []*ItemResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	m.batches = append(m.batches, ids)
+
+	return m.err
+}
+
+func (m *MockItemsSaver) savedBatches() [][]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.batches
+}
+
+func TestBatchSaver(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Items are saved once the batch is full", func(t *testing.T) {
+		saver := &MockItemsSaver{MockSaver: MockSaver{memoryStore: map[string]string{}}}
+		batch := newBatchSaver(ctx, saver, 3, 0)
+
+		require.NoError(t, batch.SaveItem(ctx, &ItemResponse{ID: 1}))
+		require.NoError(t, batch.SaveItem(ctx, &ItemResponse{ID: 2}))
+		assert.Empty(t, saver.savedBatches())
+
+		require.NoError(t, batch.SaveItem(ctx, &ItemResponse{ID: 3}))
+		assert.Equal(t, [][]int{{1, 2, 3}}, saver.savedBatches())
+
+		require.NoError(t, batch.Close(ctx))
+		assert.Len(t, saver.savedBatches(), 1)
+	})
+
+	t.Run("Items are saved every interval", func(t *testing.T) {
+		saver := &MockItemsSaver{MockSaver: MockSaver{memoryStore: map[string]string{}}}
+		batch := newBatchSaver(ctx, saver, 100, time.Millisecond*10)
+		defer batch.Close(ctx)
+
+		require.NoError(t, batch.SaveItem(ctx, &ItemResponse{ID: 1}))
+
+		assert.Eventually(t, func() bool {
+			return len(saver.savedBatches()) == 1
+		}, time.Second, time.Millisecond*5)
+	})
+
+	t.Run("Buffered items are saved before the max item and last scrape", func(t *testing.T) {
+		saver := &MockItemsSaver{MockSaver: MockSaver{memoryStore: map[string]string{}}}
+		batch := newBatchSaver(ctx, saver, 100, 0)
+
+		require.NoError(t, batch.SaveItem(ctx, &ItemResponse{ID: 1}))
+		require.NoError(t, batch.SaveMaxItem(ctx, 1))
+		assert.Equal(t, [][]int{{1}}, saver.savedBatches())
+		assert.Equal(t, 1, saver.maxItem)
+
+		require.NoError(t, batch.SaveItem(ctx, &ItemResponse{ID: 2}))
+		require.NoError(t, batch.SaveLastScrape(ctx, time.Now()))
+		assert.Equal(t, [][]int{{1}, {2}}, saver.savedBatches())
+		assert.False(t, saver.lastScrape.IsZero())
+
+		require.NoError(t, batch.Close(ctx))
+	})
+
+	t.Run("Closing saves the buffered items", func(t *testing.T) {
+		saver := &MockItemsSaver{MockSaver: MockSaver{memoryStore: map[string]string{}}}
+		batch := newBatchSaver(ctx, saver, 100, time.Hour)
+
+		require.NoError(t, batch.SaveItem(ctx, &ItemResponse{ID: 1}))
+		require.NoError(t, batch.Close(ctx))
+		assert.Equal(t, [][]int{{1}}, saver.savedBatches())
+	})
+
+	t.Run("Items are saved one by one when the saver cannot save batches", func(t *testing.T) {
+		saver := &MockSaver{memoryStore: map[string]string{}}
+		batch := newBatchSaver(ctx, saver, 2, 0)
+
+		require.NoError(t, batch.SaveItem(ctx, &ItemResponse{ID: 1, Type: "story"}))
+		require.NoError(t, batch.SaveItem(ctx, &ItemResponse{ID: 2, Type: "story"}))
+		assert.Len(t, saver.memoryStore, 2)
+
+		require.NoError(t, batch.Close(ctx))
+	})
+
+	t.Run("Errors from background saves are reported by the next write", func(t *testing.T) {
+		saver := &MockItemsSaver{MockSaver: MockSaver{memoryStore: map[string]string{}}, err: errors.New("mock: error")}
+		batch := newBatchSaver(ctx, saver, 100, time.Millisecond*10)
+
+		require.NoError(t, batch.SaveItem(ctx, &ItemResponse{ID: 1}))
+		require.Eventually(t, func() bool {
+			return len(saver.savedBatches()) >= 1
+		}, time.Second, time.Millisecond*5)
+
+		assert.EqualError(t, batch.SaveItem(ctx, &ItemResponse{ID: 2}), "mock: error")
+		assert.EqualError(t, batch.Close(ctx), "mock: error")
+	})
+
+	t.Run("Items that fail to save are retried by the next flush", func(t *testing.T) {
+		saver := &MockItemsSaver{MockSaver: MockSaver{memoryStore: map[string]string{}}, err: errors.New("mock: error")}
+		batch := newBatchSaver(ctx, saver, 2, 0)
+
+		require.NoError(t, batch.SaveItem(ctx, &ItemResponse{ID: 1}))
+		assert.EqualError(t, batch.SaveItem(ctx, &ItemResponse{ID: 2}), "mock: error")
+
+		saver.mu.Lock()
+		saver.err = nil
+		saver.mu.Unlock()
+
+		require.NoError(t, batch.SaveItem(ctx, &ItemResponse{ID: 3}))
+		assert.Equal(t, [][]int{{1, 2}, {1, 2, 3}}, saver.savedBatches())
+
+		require.NoError(t, batch.Close(ctx))
+	})
+
+	t.Run("Buffered items are saved before deletes", func(t *testing.T) {
+		saver := &MockItemsSaver{MockSaver: MockSaver{memoryStore: map[string]string{}}}
+		batch := newBatchSaver(ctx, saver, 100, 0)
+
+		require.NoError(t, batch.SaveItem(ctx, &ItemResponse{ID: 1, Type: "story"}))
+		require.NoError(t, batch.DeleteItem(ctx, &ItemResponse{ID: 1, Deleted: true}))
+		assert.Equal(t, [][]int{{1}}, saver.savedBatches())
+		assert.Equal(t, 1, saver.deleteItemCalls)
+
+		require.NoError(t, batch.Close(ctx))
+		assert.Len(t, saver.savedBatches(), 1)
+	})
+
+	t.Run("Background saves stop when the scrape is cancelled", func(t *testing.T) {
+		saver := &MockItemsSaver{MockSaver: MockSaver{memoryStore: map[string]string{}}}
+		scrapeCtx, cancel := context.WithCancel(ctx)
+		batch := newBatchSaver(scrapeCtx, saver, 100, time.Hour)
+
+		cancel()
+		<-batch.done
+
+		require.NoError(t, batch.SaveItem(ctx, &ItemResponse{ID: 1}))
+		require.NoError(t, batch.Close(ctx))
+		assert.Equal(t, [][]int{{1}}, saver.savedBatches())
+	})
+}
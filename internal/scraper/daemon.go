@@ -0,0 +1,170 @@
+package scraper
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Schedule returns the next time a scrape should run after the given time.
+type Schedule interface {
+	Next(time.Time) time.Time
+}
+
+// Interval is a Schedule that runs at a fixed interval.
+type Interval time.Duration
+
+func (i Interval) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(i))
+}
+
+// Daemon repeatedly runs a scrape on a schedule. Runs never overlap, if a
+// scrape is still in progress when the next one is due the next run is
+// skipped.
+type Daemon struct {
+	scrape      func(context.Context) (int, error)
+	schedule    Schedule
+	jitter      time.Duration
+	gracePeriod time.Duration
+	logger      *log.Logger
+	// newTimer starts the timers for scheduled runs and the grace period,
+	// returning the channel it fires on and a function to stop it.
+	newTimer func(time.Duration) (<-chan time.Time, func() bool)
+
+	running int32
+	wg      sync.WaitGroup
+}
+
+type DaemonOption func(*Daemon)
+
+func WithSchedule(schedule Schedule) DaemonOption {
+	return func(d *Daemon) {
+		d.schedule = schedule
+	}
+}
+
+// WithJitter delays every scheduled run by a random duration up to jitter, to
+// avoid many scrapers hitting the api at exactly the same time.
+func WithJitter(jitter time.Duration) DaemonOption {
+	return func(d *Daemon) {
+		d.jitter = jitter
+	}
+}
+
+// DefaultGracePeriod is how long an in-flight scrape may keep running after
+// shutdown is requested, unless set with WithGracePeriod.
+const DefaultGracePeriod = time.Second * 30
+
+// WithGracePeriod sets how long an in-flight scrape may keep running after
+// shutdown is requested before it is cancelled. A grace period of 0 cancels it
+// immediately.
+func WithGracePeriod(gracePeriod time.Duration) DaemonOption {
+	return func(d *Daemon) {
+		d.gracePeriod = gracePeriod
+	}
+}
+
+func WithLogger(logger *log.Logger) DaemonOption {
+	return func(d *Daemon) {
+		d.logger = logger
+	}
+}
+
+// NewDaemon creates a Daemon running the given scrape function, usually
+// Scraper.Scrape or Scraper.ScrapeIncremental.
+func NewDaemon(scrape func(context.Context) (int, error), opts ...DaemonOption) *Daemon {
+	daemon := &Daemon{
+		scrape:      scrape,
+		schedule:    Interval(time.Minute * 5),
+		gracePeriod: DefaultGracePeriod,
+		logger:      log.New(os.Stdout, "", log.LstdFlags),
+		newTimer:    newTimer,
+	}
+
+	for _, opt := range opts {
+		opt(daemon)
+	}
+
+	return daemon
+}
+
+// Run scrapes immediately and then on every scheduled time until ctx is
+// done. Once ctx is done any in-flight scrape is given the grace period to
+// finish before it is cancelled, and Run waits for it to stop before
+// returning.
+func (d *Daemon) Run(ctx context.Context) {
+	scrapeCtx, cancelScrapes := context.WithCancel(context.Background())
+	defer cancelScrapes()
+
+	d.trigger(scrapeCtx)
+
+	for {
+		next := d.schedule.Next(time.Now())
+		if d.jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(d.jitter))))
+		}
+
+		timer, stop := d.newTimer(time.Until(next))
+
+		select {
+		case <-ctx.Done():
+			stop()
+			d.logger.Printf("scraper: shutting down, waiting for in-flight scrape to finish")
+			d.shutdown(cancelScrapes)
+			return
+		case <-timer:
+			d.trigger(scrapeCtx)
+		}
+	}
+}
+
+// shutdown waits for any in-flight scrape to finish, cancelling it with
+// cancelScrapes once the grace period has passed.
+func (d *Daemon) shutdown(cancelScrapes context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	grace, stop := d.newTimer(d.gracePeriod)
+	defer stop()
+
+	select {
+	case <-done:
+	case <-grace:
+		cancelScrapes()
+		<-done
+	}
+}
+
+func (d *Daemon) trigger(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&d.running, 0, 1) {
+		d.logger.Printf("scraper: previous scrape still running, skipping run")
+		return
+	}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer atomic.StoreInt32(&d.running, 0)
+
+		started := time.Now()
+		items, err := d.scrape(ctx)
+		if err != nil {
+			d.logger.Printf("scraper: error running scrape: %s", err)
+			return
+		}
+
+		d.logger.Printf("scraper: successfully scraped %d items in %s", items, time.Since(started))
+	}()
+}
+
+func newTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(d)
+	return timer.C, timer.Stop
+}
@@ -0,0 +1,170 @@
+package scraper
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTimer is a timer started by the daemon, which only fires when the test
+// sends on it.
+type fakeTimer struct {
+	duration time.Duration
+	fire     chan time.Time
+}
+
+// newTestDaemon creates a daemon whose timers are sent to the returned channel
+// instead of firing on their own.
+func newTestDaemon(scrape func(context.Context) (int, error), opts ...DaemonOption) (*Daemon, chan *fakeTimer) {
+	timers := make(chan *fakeTimer, 10)
+	daemon := NewDaemon(scrape, append(opts, WithLogger(log.New(ioutil.Discard, "", 0)))...)
+	daemon.newTimer = func(d time.Duration) (<-chan time.Time, func() bool) {
+		timer := &fakeTimer{duration: d, fire: make(chan time.Time, 1)}
+		timers <- timer
+		return timer.fire, func() bool { return true }
+	}
+
+	return daemon, timers
+}
+
+// run starts the daemon, returning a channel closed once Run returns.
+func run(ctx context.Context, daemon *Daemon) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		daemon.Run(ctx)
+		close(done)
+	}()
+
+	return done
+}
+
+func TestDaemon(t *testing.T) {
+	t.Run("Daemon gives in-flight scrapes a grace period by default", func(t *testing.T) {
+		daemon := NewDaemon(func(ctx context.Context) (int, error) {
+			return 0, nil
+		})
+
+		assert.Equal(t, DefaultGracePeriod, daemon.gracePeriod)
+	})
+
+	t.Run("Daemon runs scrape on schedule", func(t *testing.T) {
+		scrapes := make(chan struct{}, 10)
+		daemon, timers := newTestDaemon(
+			func(ctx context.Context) (int, error) {
+				scrapes <- struct{}{}
+				return 0, nil
+			},
+			WithSchedule(Interval(time.Hour)),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := run(ctx, daemon)
+
+		<-scrapes
+		for i := 0; i < 3; i++ {
+			timer := <-timers
+			assert.InDelta(t, float64(time.Hour), float64(timer.duration), float64(time.Second))
+
+			timer.fire <- time.Now()
+			<-scrapes
+		}
+
+		<-timers
+		cancel()
+		<-done
+	})
+
+	t.Run("Daemon skips runs while a scrape is in progress", func(t *testing.T) {
+		scrapes := make(chan struct{}, 10)
+		release := make(chan struct{})
+		daemon, timers := newTestDaemon(
+			func(ctx context.Context) (int, error) {
+				scrapes <- struct{}{}
+				<-release
+				return 0, nil
+			},
+			WithSchedule(Interval(time.Hour)),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := run(ctx, daemon)
+
+		<-scrapes
+		(<-timers).fire <- time.Now()
+		(<-timers).fire <- time.Now()
+
+		// Once the next timer has been started both runs have been handled.
+		<-timers
+		cancel()
+		close(release)
+		<-done
+
+		assert.Len(t, scrapes, 0)
+	})
+
+	t.Run("Daemon waits for in-flight scrape on shutdown", func(t *testing.T) {
+		release := make(chan struct{})
+		finished := make(chan struct{})
+		daemon, timers := newTestDaemon(
+			func(ctx context.Context) (int, error) {
+				<-release
+				close(finished)
+				return 0, ctx.Err()
+			},
+			WithGracePeriod(time.Minute),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := run(ctx, daemon)
+
+		<-timers
+		cancel()
+
+		grace := <-timers
+		assert.Equal(t, time.Minute, grace.duration)
+
+		select {
+		case <-done:
+			t.Fatal("Run returned before the in-flight scrape finished")
+		default:
+		}
+
+		close(release)
+		<-done
+
+		select {
+		case <-finished:
+		default:
+			t.Fatal("in-flight scrape did not finish")
+		}
+	})
+
+	t.Run("Daemon cancels in-flight scrape after grace period", func(t *testing.T) {
+		errs := make(chan error, 1)
+		daemon, timers := newTestDaemon(
+			func(ctx context.Context) (int, error) {
+				<-ctx.Done()
+				errs <- ctx.Err()
+				return 0, ctx.Err()
+			},
+			WithGracePeriod(time.Minute),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := run(ctx, daemon)
+
+		<-timers
+		cancel()
+
+		(<-timers).fire <- time.Now()
+		<-done
+
+		require.Len(t, errs, 1)
+		assert.Equal(t, context.Canceled, <-errs)
+	})
+}
@@ -0,0 +1,67 @@
+package scraper
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metrics struct {
+	items    prometheus.Counter
+	users    prometheus.Counter
+	deleted  prometheus.Counter
+	runs     *prometheus.CounterVec
+	duration prometheus.Histogram
+	lastRun  prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		items: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "hn_scraper_items_fetched_total",
+			Help: "Items fetched from hacker news.",
+		}),
+		users: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "hn_scraper_users_fetched_total",
+			Help: "User profiles fetched from hacker news.",
+		}),
+		deleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "hn_scraper_items_deleted_total",
+			Help: "Fetched items that had been deleted or killed.",
+		}),
+		runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hn_scraper_runs_total",
+			Help: "Scrapes run, by whether they succeeded.",
+		}, []string{"result"}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "hn_scraper_run_duration_seconds",
+			Help:    "Time taken to run a scrape.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		}),
+		lastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "hn_scraper_last_success_timestamp_seconds",
+			Help: "When the last successful scrape finished, as a unix timestamp.",
+		}),
+	}
+}
+
+// WithMetrics registers the item counts and run durations of the scraper with
+// registerer.
+func WithMetrics(registerer prometheus.Registerer) Option {
+	return func(c *Scraper) {
+		registerer.MustRegister(c.metrics.items, c.metrics.users, c.metrics.deleted, c.metrics.runs, c.metrics.duration, c.metrics.lastRun)
+	}
+}
+
+// observeRun records the outcome and duration of a scrape started at start.
+func (m *metrics) observeRun(start time.Time, err error) {
+	m.duration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		m.runs.WithLabelValues("error").Inc()
+		return
+	}
+
+	m.runs.WithLabelValues("success").Inc()
+	m.lastRun.SetToCurrentTime()
+}
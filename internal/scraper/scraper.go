@@ -1,21 +1,80 @@
 package scraper
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 )
 
 type Saver interface {
-	SaveTopStories(TopStoriesResponse) error
-	SaveItem(*ItemResponse) error
-	DeleteItem(*ItemResponse) error
+	SaveFeed(context.Context, Feed, []int) error
+	SaveItem(context.Context, *ItemResponse) error
+	DeleteItem(context.Context, *ItemResponse) error
+	SaveUser(context.Context, *UserResponse) error
+	LastMaxItem(context.Context) (int, error)
+	SaveMaxItem(context.Context, int) error
+	SaveLastScrape(context.Context, time.Time) error
 }
+
+// Snapshot stages the writes of a single scrape, publishing them to readers
+// all at once when committed.
+type Snapshot interface {
+	Saver
+	Commit(context.Context) error
+	Discard(context.Context) error
+}
+
+// Snapshotter is implemented by savers able to stage writes in a Snapshot.
+type Snapshotter interface {
+	Snapshot(context.Context) (Snapshot, error)
+}
+
 type Client interface {
-	TopStories() (TopStoriesResponse, error)
-	Item(int) (*ItemResponse, error)
+	Feed(context.Context, Feed) ([]int, error)
+	Item(context.Context, int) (*ItemResponse, error)
+	User(context.Context, string) (*UserResponse, error)
+	MaxItem(context.Context) (int, error)
+	Updates(context.Context) (*UpdatesResponse, error)
+}
+
+// Feed is one of the story listings published by hacker news, such as the
+// front page (top) or the Ask HN section (ask).
+type Feed string
+
+const (
+	FeedTop  Feed = "top"
+	FeedNew  Feed = "new"
+	FeedBest Feed = "best"
+	FeedAsk  Feed = "ask"
+	FeedShow Feed = "show"
+	FeedJob  Feed = "job"
+)
+
+// incrementalChunkSize is how many new items ScrapeIncremental fetches between
+// saving the max item.
+const incrementalChunkSize = 1000
+
+// Feeds lists every feed hacker news publishes.
+var Feeds = []Feed{FeedTop, FeedNew, FeedBest, FeedAsk, FeedShow, FeedJob}
+
+// ParseFeed returns the Feed matching the given name, such as "top" or "ask".
+func ParseFeed(name string) (Feed, error) {
+	for _, feed := range Feeds {
+		if string(feed) == name {
+			return feed, nil
+		}
+	}
+
+	return "", fmt.Errorf("scraper: unknown feed %q", name)
 }
 
 type TopStoriesResponse []int
+type NewStoriesResponse []int
+type BestStoriesResponse []int
+type AskStoriesResponse []int
+type ShowStoriesResponse []int
+type JobStoriesResponse []int
 
 type ItemResponse struct {
 	By          string `json:"by,omitempty"`
@@ -35,10 +94,45 @@ type ItemResponse struct {
 	Dead        bool   `json:"dead,omitempty"`
 }
 
+type UserResponse struct {
+	ID        string `json:"id"`
+	Created   int    `json:"created,omitempty"`
+	Karma     int    `json:"karma,omitempty"`
+	About     string `json:"about,omitempty"`
+	Submitted []int  `json:"submitted,omitempty"`
+}
+
+// UpdatesResponse lists the items and profiles that recently changed on
+// hacker news.
+type UpdatesResponse struct {
+	Items    []int    `json:"items,omitempty"`
+	Profiles []string `json:"profiles,omitempty"`
+}
+
 type Scraper struct {
-	saver   Saver
-	client  Client
-	workers int
+	saver     Saver
+	client    Client
+	workers   int
+	feeds     []Feed
+	users     bool
+	snapshots bool
+	metrics   *metrics
+
+	batchSize     int
+	batchInterval time.Duration
+
+	// chunkSize is the most new items an incremental scrape fetches before
+	// recording its progress.
+	chunkSize int
+}
+
+// scrapeRun holds the state of a single scrape, so that scrapes can run at the
+// same time.
+type scrapeRun struct {
+	// writer is the saver the scrape writes to, which is the snapshot being
+	// staged when snapshots are enabled.
+	writer       Saver
+	scrapedUsers *sync.Map
 }
 
 type Option func(*Scraper)
@@ -61,9 +155,48 @@ func WithWorkerCount(count int) Option {
 	}
 }
 
+// WithFeeds sets which hacker news feeds are scraped. Items appearing in more
+// than one feed are only scraped once.
+func WithFeeds(feeds ...Feed) Option {
+	return func(c *Scraper) {
+		c.feeds = feeds
+	}
+}
+
+// WithUsers enables fetching the profile of the author of every scraped item.
+// Each author is only fetched once per scrape.
+func WithUsers(enabled bool) Option {
+	return func(c *Scraper) {
+		c.users = enabled
+	}
+}
+
+// WithSnapshots stages the writes of each scrape in a snapshot, only
+// publishing them once the whole scrape has succeeded so that readers never
+// see a partial scrape. The saver must implement Snapshotter.
+func WithSnapshots(enabled bool) Option {
+	return func(c *Scraper) {
+		c.snapshots = enabled
+	}
+}
+
+// WithBatching buffers the items saved by each scrape, saving them size at a
+// time and whatever has been buffered every interval. Savers implementing
+// ItemsSaver save each batch at once. Any items still buffered when a scrape
+// ends, including when it is cancelled, are saved before it returns.
+func WithBatching(size int, interval time.Duration) Option {
+	return func(c *Scraper) {
+		c.batchSize = size
+		c.batchInterval = interval
+	}
+}
+
 func NewScraper(opts ...Option) *Scraper {
 	scraper := &Scraper{
-		workers: 1,
+		workers:   1,
+		feeds:     []Feed{FeedTop},
+		metrics:   newMetrics(),
+		chunkSize: incrementalChunkSize,
 	}
 
 	for _, opt := range opts {
@@ -78,29 +211,235 @@ func NewScraper(opts ...Option) *Scraper {
 		panic(fmt.Errorf("scraper: option `WithClient` must be passed to NewScraper"))
 	}
 
+	if _, ok := scraper.saver.(Snapshotter); scraper.snapshots && !ok {
+		panic(fmt.Errorf("scraper: saver passed to NewScraper must implement Snapshotter to use `WithSnapshots`"))
+	}
+
 	return scraper
 }
 
-func (s *Scraper) Scrape() (int, error) {
-	topItems, err := s.client.TopStories()
+// Scrape fetches every configured feed and the full tree of every item in
+// them. Cancelling ctx stops any further items from being scraped.
+func (s *Scraper) Scrape(ctx context.Context) (int, error) {
+	start := time.Now()
+	count, err := s.inSnapshot(ctx, s.scrape)
+	s.metrics.observeRun(start, err)
+
+	return count, err
+}
+
+func (s *Scraper) scrape(ctx context.Context, r *scrapeRun) (int, error) {
+	items, err := s.scrapeFeeds(ctx, r)
 	if err != nil {
 		return 0, err
 	}
 
-	err = s.saver.SaveTopStories(topItems)
+	err = s.workItems(ctx, items, func(ctx context.Context, id int) error {
+		return s.scrapeItem(ctx, r, id)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(items), r.writer.SaveLastScrape(ctx, time.Now())
+}
+
+// ScrapeIncremental refreshes the feeds, then only fetches the items created
+// since the last recorded max item and the items and profiles hacker news
+// reports as updated. Nested items are not followed, as any new kids are
+// covered by the max item range. If no previous max item has been recorded a
+// full Scrape is run instead.
+//
+// New items are fetched in chunks, recording the max item after each one, so
+// a scrape that falls far behind or fails part way resumes from the last
+// finished chunk instead of starting over.
+func (s *Scraper) ScrapeIncremental(ctx context.Context) (int, error) {
+	start := time.Now()
+	count, err := s.inSnapshot(ctx, s.scrapeIncremental)
+	s.metrics.observeRun(start, err)
+
+	return count, err
+}
+
+func (s *Scraper) scrapeIncremental(ctx context.Context, r *scrapeRun) (int, error) {
+	lastMaxItem, err := s.saver.LastMaxItem(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	maxItem, err := s.client.MaxItem(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if lastMaxItem == 0 {
+		count, err := s.scrape(ctx, r)
+		if err != nil {
+			return 0, err
+		}
+
+		return count, r.writer.SaveMaxItem(ctx, maxItem)
+	}
+
+	_, err = s.scrapeFeeds(ctx, r)
+	if err != nil {
+		return 0, err
+	}
+
+	updates, err := s.client.Updates(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	refresh := func(ctx context.Context, id int) error {
+		_, err := s.refreshItem(ctx, r, id)
+		return err
+	}
+
+	var items []int
+	for _, id := range updates.Items {
+		if id <= lastMaxItem {
+			items = append(items, id)
+		}
+	}
+
+	err = s.workItems(ctx, items, refresh)
+	if err != nil {
+		return 0, err
+	}
+
+	count := len(items)
+	for start := lastMaxItem + 1; start <= maxItem; start += s.chunkSize {
+		end := start + s.chunkSize - 1
+		if end > maxItem {
+			end = maxItem
+		}
+
+		items = items[:0]
+		for id := start; id <= end; id++ {
+			items = append(items, id)
+		}
+
+		err = s.workItems(ctx, items, refresh)
+		if err != nil {
+			return 0, err
+		}
+
+		err = r.writer.SaveMaxItem(ctx, end)
+		if err != nil {
+			return 0, err
+		}
+
+		count += len(items)
+	}
+
+	if s.users {
+		for _, id := range updates.Profiles {
+			r.scrapedUsers.Delete(id)
+
+			err := s.scrapeUser(ctx, r, id)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return count, r.writer.SaveLastScrape(ctx, time.Now())
+}
+
+// inSnapshot runs scrape, staging its writes in a snapshot that is committed
+// if it succeeds and discarded if not when snapshots are enabled.
+func (s *Scraper) inSnapshot(ctx context.Context, scrape func(context.Context, *scrapeRun) (int, error)) (int, error) {
+	if !s.snapshots {
+		return s.inBatches(ctx, s.saver, scrape)
+	}
+
+	snapshot, err := s.saver.(Snapshotter).Snapshot(ctx)
 	if err != nil {
 		return 0, err
 	}
 
-	err = s.workItems(topItems)
+	count, err := s.inBatches(ctx, snapshot, scrape)
+	if err != nil {
+		return 0, discard(snapshot, err)
+	}
+
+	// Once every write has been staged, publish them even if ctx is
+	// cancelled, rather than abandoning a finished scrape.
+	err = snapshot.Commit(context.Background())
+	if err != nil {
+		return 0, discard(snapshot, err)
+	}
+
+	return count, nil
+}
+
+// discard throws away the writes staged in snapshot after err. The scrape may
+// have failed because its context was cancelled, so it is discarded without
+// it.
+func discard(snapshot Snapshot, err error) error {
+	discardErr := snapshot.Discard(context.Background())
+	if discardErr != nil {
+		return fmt.Errorf("scraper: error discarding snapshot after %s: %s", err, discardErr)
+	}
+
+	return err
+}
+
+// inBatches starts a run of scrape writing to writer, buffering saved items
+// when batching is enabled.
+func (s *Scraper) inBatches(ctx context.Context, writer Saver, scrape func(context.Context, *scrapeRun) (int, error)) (int, error) {
+	if s.batchSize <= 1 {
+		return scrape(ctx, &scrapeRun{writer: writer, scrapedUsers: &sync.Map{}})
+	}
+
+	batch := newBatchSaver(ctx, writer, s.batchSize, s.batchInterval)
+
+	count, err := scrape(ctx, &scrapeRun{writer: batch, scrapedUsers: &sync.Map{}})
+
+	// The scrape may have ended because ctx was cancelled, so save the items
+	// scraped so far without it.
+	closeErr := batch.Close(context.Background())
 	if err != nil {
 		return 0, err
 	}
+	if closeErr != nil {
+		return 0, closeErr
+	}
 
-	return len(topItems), nil
+	return count, nil
 }
 
-func (s *Scraper) workItems(items []int) error {
+// scrapeFeeds fetches and saves every configured feed, returning the unique
+// item ids across all of them.
+func (s *Scraper) scrapeFeeds(ctx context.Context, r *scrapeRun) ([]int, error) {
+	var items []int
+	seen := map[int]bool{}
+
+	for _, feed := range s.feeds {
+		feedItems, err := s.client.Feed(ctx, feed)
+		if err != nil {
+			return nil, err
+		}
+
+		err = r.writer.SaveFeed(ctx, feed, feedItems)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range feedItems {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			items = append(items, id)
+		}
+	}
+
+	return items, nil
+}
+
+func (s *Scraper) workItems(ctx context.Context, items []int, work func(context.Context, int) error) error {
 	jobs := make(chan int)
 	errs := make(chan error)
 
@@ -114,7 +453,7 @@ func (s *Scraper) workItems(items []int) error {
 					return
 				}
 
-				errs <- s.scrapeItem(j)
+				errs <- work(ctx, j)
 			}
 		}(jobs, errs, &wg)
 	}
@@ -134,15 +473,26 @@ func (s *Scraper) workItems(items []int) error {
 		}
 	}(errs, &wg)
 
+dispatch:
 	for _, id := range items {
 		wg.Add(1)
-		jobs <- id
+		select {
+		case jobs <- id:
+		case <-ctx.Done():
+			wg.Done()
+			break dispatch
+		}
 	}
 
 	wg.Wait()
 	close(jobs)
 	close(errs)
 
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
 	if len(receivedErrors) > 0 {
 		return fmt.Errorf("scrape: worker: error(s) working items to scrape: %s", receivedErrors)
 	}
@@ -150,26 +500,20 @@ func (s *Scraper) workItems(items []int) error {
 	return nil
 }
 
-func (s *Scraper) scrapeItem(id int) error {
-	item, err := s.client.Item(id)
+func (s *Scraper) scrapeItem(ctx context.Context, r *scrapeRun, id int) error {
+	item, err := s.refreshItem(ctx, r, id)
 	if err != nil {
 		return err
 	}
 
-	if item.Deleted || item.Dead {
-		err := s.saver.DeleteItem(item)
-		return err
-	}
-
-	err = s.saver.SaveItem(item)
-	if err != nil {
-		return err
+	if item == nil {
+		return nil
 	}
 
 	nested := append(item.Kids, item.Parts...)
 
 	for _, itemID := range nested {
-		err := s.scrapeItem(itemID)
+		err := s.scrapeItem(ctx, r, itemID)
 		if err != nil {
 			return err
 		}
@@ -177,3 +521,59 @@ func (s *Scraper) scrapeItem(id int) error {
 
 	return nil
 }
+
+// refreshItem fetches and saves a single item without following its nested
+// items. A nil item is returned if the item was deleted or does not exist.
+func (s *Scraper) refreshItem(ctx context.Context, r *scrapeRun, id int) (*ItemResponse, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := s.client.Item(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	s.metrics.items.Inc()
+
+	if item.ID == 0 {
+		return nil, nil
+	}
+
+	if item.Deleted || item.Dead {
+		s.metrics.deleted.Inc()
+		return nil, r.writer.DeleteItem(ctx, item)
+	}
+
+	err = r.writer.SaveItem(ctx, item)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.users && item.By != "" {
+		err = s.scrapeUser(ctx, r, item.By)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return item, nil
+}
+
+func (s *Scraper) scrapeUser(ctx context.Context, r *scrapeRun, id string) error {
+	if _, scraped := r.scrapedUsers.LoadOrStore(id, true); scraped {
+		return nil
+	}
+
+	user, err := s.client.User(ctx, id)
+	if err != nil {
+		return err
+	}
+	s.metrics.users.Inc()
+
+	if user.ID == "" {
+		return nil
+	}
+
+	return r.writer.SaveUser(ctx, user)
+}
@@ -1,12 +1,16 @@
 package scraper
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -20,20 +24,47 @@ type MockHNClient struct {
 		Error    error
 	}
 
+	FeedResults map[Feed][]int
+
+	MaxItemResult  int
+	UpdatesResult  UpdatesResponse
+	requestedItems []int
+
 	ItemResult struct {
 		Response *ItemResponse
 		Error    error
 		MaxKids  int
 	}
 
+	// failItem is an item id that Item returns an error for.
+	failItem int
+
 	returnedItemKids int
+	userCalls        int
 }
 
-func (m *MockHNClient) TopStories() (TopStoriesResponse, error) {
+func (m *MockHNClient) Feed(ctx context.Context, feed Feed) ([]int, error) {
+	if feed != FeedTop {
+		return m.FeedResults[feed], nil
+	}
 	return m.TopStoriesResult.Response, m.TopStoriesResult.Error
 }
 
-func (m *MockHNClient) Item(id int) (*ItemResponse, error) {
+func (m *MockHNClient) MaxItem(ctx context.Context) (int, error) {
+	return m.MaxItemResult, nil
+}
+
+func (m *MockHNClient) Updates(ctx context.Context) (*UpdatesResponse, error) {
+	return &m.UpdatesResult, nil
+}
+
+func (m *MockHNClient) Item(ctx context.Context, id int) (*ItemResponse, error) {
+	m.requestedItems = append(m.requestedItems, id)
+
+	if id == m.failItem {
+		return nil, errors.New("mock: item error")
+	}
+
 	if m.ItemResult.Error != nil {
 		return m.ItemResult.Response, m.ItemResult.Error
 	}
@@ -51,6 +82,11 @@ func (m *MockHNClient) Item(id int) (*ItemResponse, error) {
 	return resp, m.ItemResult.Error
 }
 
+func (m *MockHNClient) User(ctx context.Context, id string) (*UserResponse, error) {
+	m.userCalls++
+	return &UserResponse{ID: id}, nil
+}
+
 type MockSaver struct {
 	mock.Mock
 
@@ -65,16 +101,22 @@ type MockSaver struct {
 	}
 
 	deleteItemCalls int
+	maxItem         int
+	lastScrape      time.Time
 }
 
-func (m *MockSaver) SaveTopStories(topStories TopStoriesResponse) error {
-	data, _ := json.Marshal(topStories)
-	m.memoryStore["topStories"] = string(data)
+func (m *MockSaver) SaveFeed(ctx context.Context, feed Feed, items []int) error {
+	data, _ := json.Marshal(items)
+	if feed == FeedTop {
+		m.memoryStore["topStories"] = string(data)
+	} else {
+		m.memoryStore[fmt.Sprintf("feed_%s", feed)] = string(data)
+	}
 
 	return m.SaveTopStoriesResult.Error
 }
 
-func (m *MockSaver) SaveItem(item *ItemResponse) error {
+func (m *MockSaver) SaveItem(ctx context.Context, item *ItemResponse) error {
 	itemKey := fmt.Sprintf("item_%s_%d", item.Type, item.ID)
 	data, _ := json.Marshal(item)
 	m.memoryStore[itemKey] = string(data)
@@ -82,11 +124,69 @@ func (m *MockSaver) SaveItem(item *ItemResponse) error {
 	return m.SaveItemResult.Error
 }
 
-func (m *MockSaver) DeleteItem(item *ItemResponse) error {
+func (m *MockSaver) DeleteItem(ctx context.Context, item *ItemResponse) error {
 	m.deleteItemCalls++
 	return nil
 }
 
+func (m *MockSaver) SaveUser(ctx context.Context, user *UserResponse) error {
+	data, _ := json.Marshal(user)
+	m.memoryStore[fmt.Sprintf("user_%s", user.ID)] = string(data)
+
+	return nil
+}
+
+func (m *MockSaver) LastMaxItem(ctx context.Context) (int, error) {
+	return m.maxItem, nil
+}
+
+func (m *MockSaver) SaveMaxItem(ctx context.Context, id int) error {
+	m.maxItem = id
+	return nil
+}
+
+func (m *MockSaver) SaveLastScrape(ctx context.Context, at time.Time) error {
+	m.lastScrape = at
+	return nil
+}
+
+type MockSnapshotSaver struct {
+	MockSaver
+
+	snapshot    *MockSnapshot
+	commitError error
+}
+
+func (m *MockSnapshotSaver) Snapshot(ctx context.Context) (Snapshot, error) {
+	m.snapshot = &MockSnapshot{MockSaver: MockSaver{memoryStore: map[string]string{}}, commitError: m.commitError}
+	m.snapshot.SaveItemResult = m.SaveItemResult
+	return m.snapshot, nil
+}
+
+type MockSnapshot struct {
+	MockSaver
+
+	commitError error
+	commitCtx   context.Context
+	committed   bool
+	discarded   bool
+}
+
+func (m *MockSnapshot) Commit(ctx context.Context) error {
+	m.commitCtx = ctx
+	if m.commitError != nil {
+		return m.commitError
+	}
+
+	m.committed = true
+	return nil
+}
+
+func (m *MockSnapshot) Discard(ctx context.Context) error {
+	m.discarded = true
+	return nil
+}
+
 func TestNewScraper(t *testing.T) {
 	mockClient := &MockHNClient{}
 	mockSaver := &MockSaver{
@@ -100,6 +200,16 @@ func TestNewScraper(t *testing.T) {
 	t.Run("NewScraper returns implementation of Scraper", func(t *testing.T) {
 		require.IsType(t, &Scraper{}, scraper)
 	})
+
+	t.Run("NewScraper panics when snapshots are not supported by the saver", func(t *testing.T) {
+		assert.Panics(t, func() {
+			NewScraper(
+				WithClient(mockClient),
+				WithSaver(mockSaver),
+				WithSnapshots(true),
+			)
+		})
+	})
 }
 
 func TestScrape(t *testing.T) {
@@ -151,7 +261,7 @@ func TestScrape(t *testing.T) {
 
 			expectedSavedTopItems, _ := json.Marshal(opts.topStoriesResponse)
 
-			result, err := scraper.Scrape()
+			result, err := scraper.Scrape(context.Background())
 
 			stored, ok := mockSaver.memoryStore["topStories"]
 
@@ -173,3 +283,387 @@ func TestScrape(t *testing.T) {
 		})
 	}
 }
+
+func TestScrapeFeeds(t *testing.T) {
+	mockClient := &MockHNClient{}
+	mockClient.TopStoriesResult.Response = TopStoriesResponse{1, 2, 3}
+	mockClient.FeedResults = map[Feed][]int{
+		FeedAsk:  {3, 4},
+		FeedShow: {5},
+	}
+	mockClient.ItemResult.Response = &ItemResponse{Type: "story"}
+
+	mockSaver := &MockSaver{
+		memoryStore: map[string]string{},
+	}
+	scraper := NewScraper(
+		WithClient(mockClient),
+		WithSaver(mockSaver),
+		WithFeeds(FeedTop, FeedAsk, FeedShow),
+	)
+
+	result, err := scraper.Scrape(context.Background())
+
+	require.NoError(t, err)
+	assert.Equal(t, 5, result)
+	assert.Equal(t, "[3,4]", mockSaver.memoryStore["feed_ask"])
+	assert.Equal(t, "[5]", mockSaver.memoryStore["feed_show"])
+	assert.Len(t, mockSaver.memoryStore, 8)
+}
+
+func TestParseFeed(t *testing.T) {
+	feed, err := ParseFeed("ask")
+	require.NoError(t, err)
+	assert.Equal(t, FeedAsk, feed)
+
+	_, err = ParseFeed("unknown")
+	require.Error(t, err)
+}
+
+func TestScrapeUsers(t *testing.T) {
+	mockClient := &MockHNClient{}
+	mockClient.TopStoriesResult.Response = TopStoriesResponse{1, 2, 3}
+	mockClient.ItemResult.Response = &ItemResponse{Type: "story", By: "exampleuser"}
+
+	mockSaver := &MockSaver{
+		memoryStore: map[string]string{},
+	}
+	scraper := NewScraper(
+		WithClient(mockClient),
+		WithSaver(mockSaver),
+		WithUsers(true),
+	)
+
+	_, err := scraper.Scrape(context.Background())
+
+	require.NoError(t, err)
+	assert.Equal(t, 1, mockClient.userCalls)
+	assert.Equal(t, `{"id":"exampleuser"}`, mockSaver.memoryStore["user_exampleuser"])
+}
+
+func TestScrapeIncremental(t *testing.T) {
+	t.Run("ScrapeIncremental runs a full scrape without a previous max item", func(t *testing.T) {
+		mockClient := &MockHNClient{}
+		mockClient.TopStoriesResult.Response = TopStoriesResponse{1, 2}
+		mockClient.ItemResult.Response = &ItemResponse{Type: "story"}
+		mockClient.MaxItemResult = 10
+
+		mockSaver := &MockSaver{
+			memoryStore: map[string]string{},
+		}
+		scraper := NewScraper(
+			WithClient(mockClient),
+			WithSaver(mockSaver),
+		)
+
+		result, err := scraper.ScrapeIncremental(context.Background())
+
+		require.NoError(t, err)
+		assert.Equal(t, 2, result)
+		assert.Equal(t, []int{1, 2}, mockClient.requestedItems)
+		assert.Equal(t, 10, mockSaver.maxItem)
+		assert.False(t, mockSaver.lastScrape.IsZero())
+	})
+
+	t.Run("ScrapeIncremental only fetches new and updated items", func(t *testing.T) {
+		mockClient := &MockHNClient{}
+		mockClient.TopStoriesResult.Response = TopStoriesResponse{1, 2}
+		mockClient.ItemResult.Response = &ItemResponse{Type: "story"}
+		mockClient.ItemResult.MaxKids = 5
+		mockClient.MaxItemResult = 12
+		mockClient.UpdatesResult = UpdatesResponse{Items: []int{3, 11}}
+
+		mockSaver := &MockSaver{
+			memoryStore: map[string]string{},
+			maxItem:     10,
+		}
+		scraper := NewScraper(
+			WithClient(mockClient),
+			WithSaver(mockSaver),
+		)
+
+		result, err := scraper.ScrapeIncremental(context.Background())
+
+		require.NoError(t, err)
+		assert.Equal(t, 3, result)
+		assert.ElementsMatch(t, []int{11, 12, 3}, mockClient.requestedItems)
+		assert.Equal(t, 12, mockSaver.maxItem)
+		assert.False(t, mockSaver.lastScrape.IsZero())
+		assert.Equal(t, float64(3), testutil.ToFloat64(scraper.metrics.items))
+		assert.Equal(t, float64(1), testutil.ToFloat64(scraper.metrics.runs.WithLabelValues("success")))
+	})
+
+	t.Run("ScrapeIncremental keeps the progress of finished chunks when a later chunk fails", func(t *testing.T) {
+		mockClient := &MockHNClient{failItem: 16}
+		mockClient.ItemResult.Response = &ItemResponse{Type: "story"}
+		mockClient.MaxItemResult = 20
+
+		mockSaver := &MockSaver{
+			memoryStore: map[string]string{},
+			maxItem:     10,
+		}
+		scraper := NewScraper(
+			WithClient(mockClient),
+			WithSaver(mockSaver),
+		)
+		scraper.chunkSize = 3
+
+		_, err := scraper.ScrapeIncremental(context.Background())
+
+		require.Error(t, err)
+		assert.Equal(t, 13, mockSaver.maxItem)
+		assert.True(t, mockSaver.lastScrape.IsZero())
+
+		mockClient.failItem = 0
+		mockClient.requestedItems = nil
+
+		result, err := scraper.ScrapeIncremental(context.Background())
+
+		require.NoError(t, err)
+		assert.Equal(t, 7, result)
+		assert.Equal(t, []int{14, 15, 16, 17, 18, 19, 20}, mockClient.requestedItems)
+		assert.Equal(t, 20, mockSaver.maxItem)
+	})
+}
+
+func TestScrapeCancelled(t *testing.T) {
+	mockClient := &MockHNClient{}
+	mockClient.TopStoriesResult.Response = TopStoriesResponse{1, 2, 3, 4}
+	mockClient.ItemResult.Response = &ItemResponse{Type: "story"}
+
+	mockSaver := &MockSaver{
+		memoryStore: map[string]string{},
+	}
+	scraper := NewScraper(
+		WithClient(mockClient),
+		WithSaver(mockSaver),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := scraper.Scrape(ctx)
+
+	require.Error(t, err)
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, mockClient.requestedItems)
+}
+
+func TestScrapeSnapshots(t *testing.T) {
+	type test struct {
+		saverError  error
+		commitError error
+		committed   bool
+	}
+
+	tests := map[string]test{
+		"Scrape commits the snapshot when successful":        {committed: true},
+		"Scrape discards the snapshot when failing":          {saverError: errors.New("mock: error")},
+		"Scrape discards the snapshot when committing fails": {commitError: errors.New("mock: error")},
+	}
+
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			mockClient := &MockHNClient{}
+			mockClient.TopStoriesResult.Response = TopStoriesResponse{1, 2}
+			mockClient.ItemResult.Response = &ItemResponse{Type: "story"}
+
+			mockSaver := &MockSnapshotSaver{
+				MockSaver:   MockSaver{memoryStore: map[string]string{}},
+				commitError: opts.commitError,
+			}
+			scraper := NewScraper(
+				WithClient(mockClient),
+				WithSaver(mockSaver),
+				WithSnapshots(true),
+			)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			mockSaver.SaveItemResult.Error = opts.saverError
+			_, err := scraper.Scrape(ctx)
+			cancel()
+			require.NotNil(t, mockSaver.snapshot)
+
+			if opts.saverError != nil || opts.commitError != nil {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Len(t, mockSaver.snapshot.memoryStore, 3)
+				assert.False(t, mockSaver.snapshot.lastScrape.IsZero())
+			}
+
+			assert.Empty(t, mockSaver.memoryStore)
+			assert.Equal(t, opts.committed, mockSaver.snapshot.committed)
+			assert.Equal(t, !opts.committed, mockSaver.snapshot.discarded)
+			if mockSaver.snapshot.commitCtx != nil {
+				assert.NoError(t, mockSaver.snapshot.commitCtx.Err(), "commit is not cancelled with the scrape")
+			}
+		})
+	}
+}
+
+// StaticHNClient serves the same feed, items and users to any number of
+// concurrent scrapes.
+type StaticHNClient struct {
+	MockHNClient
+
+	feed []int
+}
+
+func (m *StaticHNClient) Feed(ctx context.Context, feed Feed) ([]int, error) {
+	return m.feed, nil
+}
+
+func (m *StaticHNClient) Item(ctx context.Context, id int) (*ItemResponse, error) {
+	return &ItemResponse{ID: id, Type: "story", By: fmt.Sprintf("user%d", id)}, nil
+}
+
+func (m *StaticHNClient) User(ctx context.Context, id string) (*UserResponse, error) {
+	return &UserResponse{ID: id}, nil
+}
+
+// RecordingSnapshotter records what each of its snapshots is sent.
+type RecordingSnapshotter struct {
+	MockSaver
+
+	mu        sync.Mutex
+	snapshots []*RecordingSnapshot
+}
+
+func (m *RecordingSnapshotter) Snapshot(ctx context.Context) (Snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := &RecordingSnapshot{items: map[int]int{}, users: map[string]int{}}
+	m.snapshots = append(m.snapshots, snapshot)
+
+	return snapshot, nil
+}
+
+type RecordingSnapshot struct {
+	MockSaver
+
+	mu    sync.Mutex
+	items map[int]int
+	users map[string]int
+}
+
+func (m *RecordingSnapshot) SaveFeed(ctx context.Context, feed Feed, items []int) error {
+	return nil
+}
+
+func (m *RecordingSnapshot) SaveItem(ctx context.Context, item *ItemResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.items[item.ID]++
+	return nil
+}
+
+func (m *RecordingSnapshot) SaveUser(ctx context.Context, user *UserResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.users[user.ID]++
+	return nil
+}
+
+func (m *RecordingSnapshot) SaveLastScrape(ctx context.Context, at time.Time) error {
+	return nil
+}
+
+func (m *RecordingSnapshot) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (m *RecordingSnapshot) Discard(ctx context.Context) error {
+	return nil
+}
+
+func TestScrapeConcurrently(t *testing.T) {
+	var feed []int
+	for id := 1; id <= 50; id++ {
+		feed = append(feed, id)
+	}
+
+	saver := &RecordingSnapshotter{}
+	scraper := NewScraper(
+		WithClient(&StaticHNClient{feed: feed}),
+		WithSaver(saver),
+		WithWorkerCount(4),
+		WithUsers(true),
+		WithSnapshots(true),
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := scraper.Scrape(context.Background())
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	t.Run("Concurrent scrapes write to their own snapshots and fetch their own users", func(t *testing.T) {
+		require.Len(t, saver.snapshots, 2)
+		for _, snapshot := range saver.snapshots {
+			assert.Len(t, snapshot.items, len(feed))
+			assert.Len(t, snapshot.users, len(feed))
+			for _, saved := range snapshot.items {
+				assert.Equal(t, 1, saved)
+			}
+			for _, saved := range snapshot.users {
+				assert.Equal(t, 1, saved)
+			}
+		}
+	})
+}
+
+func TestScrapeBatching(t *testing.T) {
+	type test struct {
+		saverError error
+	}
+
+	tests := map[string]test{
+		"Scrape saves every item in batches":   {},
+		"Scrape reports errors saving batches": {saverError: errors.New("mock: error")},
+	}
+
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			mockClient := &MockHNClient{}
+			mockClient.TopStoriesResult.Response = TopStoriesResponse{1, 2, 3}
+			mockClient.ItemResult.Response = &ItemResponse{Type: "story"}
+
+			mockSaver := &MockItemsSaver{
+				MockSaver: MockSaver{memoryStore: map[string]string{}},
+				err:       opts.saverError,
+			}
+			scraper := NewScraper(
+				WithClient(mockClient),
+				WithSaver(mockSaver),
+				WithBatching(2, time.Hour),
+			)
+
+			_, err := scraper.Scrape(context.Background())
+
+			if opts.saverError != nil {
+				assert.Error(t, err)
+				assert.True(t, mockSaver.lastScrape.IsZero())
+				return
+			}
+
+			require.NoError(t, err)
+			// The mock client reuses one item for every response, so only the
+			// batch sizes can be checked.
+			batches := mockSaver.savedBatches()
+			require.Len(t, batches, 2)
+			assert.Len(t, batches[0], 2)
+			assert.Len(t, batches[1], 1)
+			assert.False(t, mockSaver.lastScrape.IsZero())
+		})
+	}
+}
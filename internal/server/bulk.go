@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// MaxBulkItems is the most items that can be requested from the bulk items
+// endpoint at once.
+const MaxBulkItems = 1000
+
+// BulkItem is the result of looking up a single id in a bulk request. Items
+// that are not stored, or have been deleted, are marked as such rather than
+// failing the whole request.
+type BulkItem struct {
+	ID       int           `json:"id"`
+	Item     *ItemResponse `json:"item,omitempty"`
+	NotFound bool          `json:"not_found,omitempty"`
+	Gone     bool          `json:"gone,omitempty"`
+}
+
+type BulkItemsResponse struct {
+	Items []BulkItem `json:"items"`
+}
+
+type bulkItemsRequest struct {
+	IDs []int `json:"ids"`
+}
+
+// bulkItemsHandler serves the items listed in the ids query parameter, or in
+// the JSON body of a POST request for lists too long for a url. Items are
+// returned in the order they were requested.
+func (conf *Config) bulkItemsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var ids []int
+	var err error
+	if c.Request().Method == http.MethodPost {
+		ids, err = bindBulkIDs(c)
+	} else {
+		ids, err = parseBulkIDs(c.QueryParam("ids"))
+	}
+	if err != nil {
+		return err
+	}
+
+	savedItems, err := conf.store.GetItems(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	response := &BulkItemsResponse{Items: make([]BulkItem, 0, len(ids))}
+	for i, savedItem := range savedItems {
+		result := BulkItem{ID: ids[i]}
+		switch {
+		case savedItem == nil:
+			result.NotFound = true
+		case savedItem.Deleted || savedItem.Dead:
+			result.Gone = true
+		default:
+			result.Item = newItemResponse(savedItem)
+		}
+
+		response.Items = append(response.Items, result)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func parseBulkIDs(param string) ([]int, error) {
+	var ids []int
+	for _, value := range strings.Split(param, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		id, err := strconv.Atoi(value)
+		if err != nil || id < 1 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid item id %q", value))
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, validateBulkIDs(ids)
+}
+
+func bindBulkIDs(c echo.Context) ([]int, error) {
+	var request bulkItemsRequest
+	err := c.Bind(&request)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "body must be a JSON object with a list of ids")
+	}
+
+	for _, id := range request.IDs {
+		if id < 1 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid item id %d", id))
+		}
+	}
+
+	return request.IDs, validateBulkIDs(request.IDs)
+}
+
+func validateBulkIDs(ids []int) error {
+	if len(ids) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "at least one id is required")
+	}
+
+	if len(ids) > MaxBulkItems {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("at most %d ids can be requested at once", MaxBulkItems))
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	errNotFound = errors.New("server: not found")
+	errGone     = errors.New("server: gone")
+)
+
+// ErrorResponse is the body of every error returned by the API.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// statusClientClosedRequest is the non standard status logged when a client
+// goes away before its response is ready.
+const statusClientClosedRequest = 499
+
+// errorHandler renders errors returned by handlers as an ErrorResponse.
+// Network errors and timeouts reaching storage are reported as the service
+// being unavailable, and any other unexpected error as an internal error.
+// Both are logged, while requests cancelled by the client are not.
+func errorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	status := http.StatusInternalServerError
+	message := "internal server error"
+
+	var httpError *echo.HTTPError
+	var netError net.Error
+	switch {
+	case errors.As(err, &httpError):
+		status = httpError.Code
+		message = fmt.Sprint(httpError.Message)
+		if httpError.Internal != nil {
+			c.Logger().Error(httpError.Internal)
+		}
+	case errors.Is(err, errNotFound):
+		status = http.StatusNotFound
+		message = "not found"
+	case errors.Is(err, errGone):
+		status = http.StatusGone
+		message = "item has been deleted"
+	case errors.Is(err, context.Canceled):
+		status = statusClientClosedRequest
+		message = "request cancelled"
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusServiceUnavailable
+		message = "storage timed out"
+		c.Logger().Error(err)
+	case errors.As(err, &netError):
+		status = http.StatusServiceUnavailable
+		message = "storage unavailable"
+		c.Logger().Error(err)
+	default:
+		c.Logger().Error(err)
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(status)
+	} else {
+		err = c.JSON(status, &ErrorResponse{Error: ErrorDetail{Status: status, Message: message}})
+	}
+
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
+
+// storageUnavailable reports err, returned while checking that storage can be
+// reached, as the service being unavailable whatever caused it.
+func storageUnavailable(err error) error {
+	return echo.NewHTTPError(http.StatusServiceUnavailable, "storage unavailable").SetInternal(err)
+}
+
+func parseItemID(c echo.Context) (int, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 1 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid item id %q", c.Param("id")))
+	}
+
+	return id, nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jralph/hackernews-api/internal/scraper"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	ExpandKids   = "kids"
+	ExpandParent = "parent"
+	ExpandParts  = "parts"
+	ExpandAuthor = "author"
+)
+
+// expandOptions selects which related resources are inlined into an item
+// response rather than returned as bare listings.
+type expandOptions struct {
+	kids   bool
+	parent bool
+	parts  bool
+	author bool
+}
+
+// parseExpand reads the comma separated expand query parameter.
+func parseExpand(c echo.Context) (expandOptions, error) {
+	var expand expandOptions
+
+	for _, name := range strings.Split(c.QueryParam("expand"), ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case ExpandKids:
+			expand.kids = true
+		case ExpandParent:
+			expand.parent = true
+		case ExpandParts:
+			expand.parts = true
+		case ExpandAuthor:
+			expand.author = true
+		default:
+			return expand, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("expand must be a list of %s, %s, %s or %s", ExpandKids, ExpandParent, ExpandParts, ExpandAuthor))
+		}
+	}
+
+	return expand, nil
+}
+
+// String lists the expanded resources in a fixed order, so that equivalent
+// requests share a cache entry.
+func (e expandOptions) String() string {
+	var names []string
+	if e.kids {
+		names = append(names, ExpandKids)
+	}
+	if e.parent {
+		names = append(names, ExpandParent)
+	}
+	if e.parts {
+		names = append(names, ExpandParts)
+	}
+	if e.author {
+		names = append(names, ExpandAuthor)
+	}
+
+	return strings.Join(names, ",")
+}
+
+// expandItem inlines the related resources selected by expand into item. The
+// kids, parts and parent are loaded with a single bulk fetch.
+func (conf *Config) expandItem(ctx context.Context, item *ItemResponse, savedItem *scraper.ItemResponse, expand expandOptions) error {
+	var listings []*ItemListing
+	if expand.kids {
+		listings = append(listings, item.Kids...)
+	}
+	if expand.parts {
+		listings = append(listings, item.Parts...)
+	}
+	if expand.parent && item.Parent != nil {
+		listings = append(listings, item.Parent)
+	}
+
+	if len(listings) > 0 {
+		ids := make([]int, 0, len(listings))
+		for _, listing := range listings {
+			ids = append(ids, listing.ID)
+		}
+
+		savedItems, err := conf.store.GetItems(ctx, ids)
+		if err != nil {
+			return err
+		}
+
+		for i, related := range savedItems {
+			if related != nil && !related.Deleted && !related.Dead {
+				listings[i].Item = newItemResponse(related)
+			}
+		}
+	}
+
+	if expand.author && savedItem.By != "" {
+		savedUser, err := conf.store.GetUser(ctx, savedItem.By)
+		if err != nil {
+			return err
+		}
+
+		if savedUser != nil {
+			item.Author = newUserResponse(savedUser)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	SortID          = ""
+	SortScore       = "score"
+	SortTime        = "time"
+	SortDescendants = "descendants"
+)
+
+var sorts = map[string]bool{
+	SortID:          true,
+	SortScore:       true,
+	SortTime:        true,
+	SortDescendants: true,
+}
+
+// filterParams are the query parameters read by parseFilters.
+var filterParams = []string{"sort", "order", "by", "type", "min_score", "since", "until"}
+
+// rejectFilters returns a 400 if any sort or filter parameter has been passed,
+// for listings that are kept in a fixed order and cannot be sorted or
+// filtered.
+func rejectFilters(c echo.Context) error {
+	for _, param := range filterParams {
+		if c.QueryParam(param) != "" {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s is not supported on this listing", param))
+		}
+	}
+
+	return nil
+}
+
+// parseFilters reads the sort, order, by, type, min_score, since and until
+// query parameters. Sorting by anything other than id defaults to descending
+// order.
+func parseFilters(c echo.Context, query *ListQuery) error {
+	query.Sort = c.QueryParam("sort")
+	if query.Sort == "id" {
+		query.Sort = SortID
+	}
+	if !sorts[query.Sort] {
+		return echo.NewHTTPError(http.StatusBadRequest, "sort must be one of id, score, time or descendants")
+	}
+
+	switch c.QueryParam("order") {
+	case "":
+		query.Desc = query.Sort != SortID
+	case "asc":
+		query.Desc = false
+	case "desc":
+		query.Desc = true
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "order must be one of asc or desc")
+	}
+
+	query.By = c.QueryParam("by")
+	query.Type = c.QueryParam("type")
+
+	if minScore := c.QueryParam("min_score"); minScore != "" {
+		parsed, err := strconv.Atoi(minScore)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "min_score must be a number")
+		}
+		query.MinScore = &parsed
+	}
+
+	var err error
+	query.Since, err = parseTime(c.QueryParam("since"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "since must be a unix timestamp or RFC 3339 time")
+	}
+
+	query.Until, err = parseTime(c.QueryParam("until"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "until must be a unix timestamp or RFC 3339 time")
+	}
+
+	return nil
+}
+
+// parseTime parses a unix timestamp or RFC 3339 time into a unix timestamp,
+// matching the time field of items.
+func parseTime(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	if timestamp, err := strconv.Atoi(value); err == nil {
+		return timestamp, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(parsed.Unix()), nil
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// StoreStatus summarises the data held in storage.
+type StoreStatus struct {
+	LastScrape time.Time
+	Items      int
+	Types      map[string]int
+}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+type StatusResponse struct {
+	LastScrape     *time.Time     `json:"last_scrape"`
+	Items          int            `json:"items"`
+	Types          map[string]int `json:"types"`
+	StoreLatencyMS float64        `json:"store_latency_ms"`
+}
+
+// healthHandler reports that the process is alive, without touching storage.
+func (conf *Config) healthHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, &HealthResponse{Status: "ok"})
+}
+
+// readyHandler reports whether storage is reachable and has been populated by
+// the scraper, so traffic is only routed to instances that can serve it.
+func (conf *Config) readyHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	err := conf.store.Ping(ctx)
+	if err != nil {
+		return storageUnavailable(err)
+	}
+
+	status, err := conf.store.Status(ctx)
+	if err != nil {
+		return storageUnavailable(err)
+	}
+
+	if status.Items == 0 {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "no items have been scraped yet")
+	}
+
+	return c.JSON(http.StatusOK, &HealthResponse{Status: "ready"})
+}
+
+// statusHandler reports when the scraper last ran, how many items of each
+// type are stored and how long storage takes to respond.
+func (conf *Config) statusHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	start := time.Now()
+	err := conf.store.Ping(ctx)
+	if err != nil {
+		return storageUnavailable(err)
+	}
+	latency := time.Since(start)
+
+	status, err := conf.store.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	response := &StatusResponse{
+		Items:          status.Items,
+		Types:          status.Types,
+		StoreLatencyMS: float64(latency) / float64(time.Millisecond),
+	}
+	if !status.LastScrape.IsZero() {
+		lastScrape := status.LastScrape.UTC()
+		response.LastScrape = &lastScrape
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type metrics struct {
+	requests *prometheus.HistogramVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "hn_api_request_duration_seconds",
+			Help:    "Time taken to serve requests, by route and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+	}
+}
+
+// WithMetrics registers the request metrics of the server with registry and
+// serves everything gathered by registry from /metrics.
+func WithMetrics(registry *prometheus.Registry) Option {
+	return func(c *Config) {
+		registry.MustRegister(c.metrics.requests)
+		c.gatherer = registry
+	}
+}
+
+// middleware records the latency of every request against the route it
+// matched, rather than its path, to keep the number of series bounded.
+func (m *metrics) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+
+		err := next(c)
+		if err != nil {
+			// Render the error now so the status code it results in is known.
+			c.Error(err)
+		}
+
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		m.requests.WithLabelValues(c.Request().Method, route, strconv.Itoa(c.Response().Status)).Observe(time.Since(start).Seconds())
+
+		return nil
+	}
+}
+
+func metricsHandler(gatherer prometheus.Gatherer) echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+}
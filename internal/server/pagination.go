@@ -0,0 +1,285 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// ListQuery selects a page of a listing, optionally sorted and filtered. The
+// zero value lists everything in ascending id order.
+type ListQuery struct {
+	Offset int
+	Limit  int
+
+	Sort string
+	Desc bool
+
+	By       string
+	Type     string
+	MinScore *int
+	Since    int
+	Until    int
+}
+
+// ListResult is a page of item ids along with the size of the full listing.
+type ListResult struct {
+	IDs   []int
+	Total int
+}
+
+type ListResponse struct {
+	Items  AllItemsResponse `json:"items"`
+	Total  int              `json:"total"`
+	Offset int              `json:"offset"`
+	Limit  int              `json:"limit"`
+	Next   string           `json:"next,omitempty"`
+	Prev   string           `json:"prev,omitempty"`
+}
+
+// listFetcher fetches a page of a listing. Listings may be fetched in the
+// background to refresh the cache after the request has been served, so are
+// given the path parameters of the request rather than its echo.Context.
+type listFetcher func(context.Context, pathParams, ListQuery) (ListResult, error)
+
+type pathParams map[string]string
+
+func newPathParams(c echo.Context) pathParams {
+	params := pathParams{}
+	for i, name := range c.ParamNames() {
+		params[name] = c.ParamValues()[i]
+	}
+
+	return params
+}
+
+// listHandler serves a paginated listing of items, fetching the requested page
+// with fetch. If fetch returns errNotFound a 404 is returned.
+func (conf *Config) listHandler(fetch listFetcher) echo.HandlerFunc {
+	return conf.pageHandler(fetch, false, true)
+}
+
+// orderedHandler serves a paginated listing kept in a fixed order, such as the
+// items submitted by a user. Sorting and filters are rejected.
+func (conf *Config) orderedHandler(fetch listFetcher) echo.HandlerFunc {
+	return conf.pageHandler(fetch, false, false)
+}
+
+// feedHandler serves a paginated listing of a feed, numbering every item with
+// its rank in the feed. Feeds are kept in rank order, so sorting and filters
+// are rejected.
+func (conf *Config) feedHandler(fetch listFetcher) echo.HandlerFunc {
+	return conf.pageHandler(fetch, true, false)
+}
+
+func (conf *Config) pageHandler(fetch listFetcher, ranked bool, filtered bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		if !filtered {
+			err := rejectFilters(c)
+			if err != nil {
+				return err
+			}
+		}
+
+		query, err := parseListQuery(c)
+		if err != nil {
+			return err
+		}
+
+		params := newPathParams(c)
+		path := c.Request().URL.Path
+		key := fmt.Sprintf("%s?%s", strings.TrimPrefix(path, "/"), query)
+
+		data := &ListResponse{}
+		err = conf.store.Cache(ctx, key, time.Minute*5, data, func(ctx context.Context) (interface{}, error) {
+			result, err := fetch(ctx, params, query)
+			if err != nil {
+				return nil, err
+			}
+
+			return newListResponse(path, query, result, ranked), nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, data)
+	}
+}
+
+// parseListQuery reads the limit, offset and cursor query parameters along
+// with any sorting and filters. A cursor takes precedence over an offset.
+func parseListQuery(c echo.Context) (ListQuery, error) {
+	query := ListQuery{Limit: DefaultLimit}
+
+	if limit := c.QueryParam("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 1 || parsed > MaxLimit {
+			return query, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", MaxLimit))
+		}
+		query.Limit = parsed
+	}
+
+	if offset := c.QueryParam("offset"); offset != "" {
+		parsed, err := strconv.Atoi(offset)
+		if err != nil || parsed < 0 {
+			return query, echo.NewHTTPError(http.StatusBadRequest, "offset must be a positive number")
+		}
+		query.Offset = parsed
+	}
+
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		offset, err := decodeCursor(cursor)
+		if err != nil {
+			return query, echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+		}
+		query.Offset = offset
+	}
+
+	err := parseFilters(c, &query)
+	if err != nil {
+		return query, err
+	}
+
+	return query, nil
+}
+
+// values encodes the sorting and filters of the query in a fixed form, leaving
+// out defaults and any unknown parameters of the request it was parsed from.
+func (q ListQuery) values() url.Values {
+	values := url.Values{}
+	if q.Sort != SortID {
+		values.Set("sort", q.Sort)
+	}
+	if q.Desc != (q.Sort != SortID) {
+		if q.Desc {
+			values.Set("order", "desc")
+		} else {
+			values.Set("order", "asc")
+		}
+	}
+	if q.By != "" {
+		values.Set("by", q.By)
+	}
+	if q.Type != "" {
+		values.Set("type", q.Type)
+	}
+	if q.MinScore != nil {
+		values.Set("min_score", strconv.Itoa(*q.MinScore))
+	}
+	if q.Since != 0 {
+		values.Set("since", strconv.Itoa(q.Since))
+	}
+	if q.Until != 0 {
+		values.Set("until", strconv.Itoa(q.Until))
+	}
+
+	return values
+}
+
+// String encodes the whole query in a fixed form, so that equivalent requests
+// share a cache entry.
+func (q ListQuery) String() string {
+	values := q.values()
+	values.Set("limit", strconv.Itoa(q.Limit))
+	values.Set("offset", strconv.Itoa(q.Offset))
+
+	return values.Encode()
+}
+
+// pageIDs returns the page of ids selected by query, for listings that are
+// already held in memory.
+func pageIDs(ids []int, query ListQuery) ListResult {
+	result := ListResult{Total: len(ids), IDs: []int{}}
+	if query.Offset >= len(ids) {
+		return result
+	}
+
+	end := len(ids)
+	if query.Limit > 0 && query.Offset+query.Limit < end {
+		end = query.Offset + query.Limit
+	}
+	result.IDs = ids[query.Offset:end]
+
+	return result
+}
+
+func newListResponse(path string, query ListQuery, result ListResult, ranked bool) *ListResponse {
+	response := &ListResponse{
+		Items:  AllItemsResponse{},
+		Total:  result.Total,
+		Offset: query.Offset,
+		Limit:  query.Limit,
+	}
+
+	for i, id := range result.IDs {
+		listing := ItemListing{
+			ID:       id,
+			Location: fmt.Sprintf("/items/%d", id),
+		}
+		if ranked {
+			listing.Rank = query.Offset + i + 1
+		}
+
+		response.Items = append(response.Items, listing)
+	}
+
+	if query.Offset+query.Limit < result.Total {
+		response.Next = pageLink(path, query, query.Offset+query.Limit)
+	}
+
+	if query.Offset > 0 {
+		prev := query.Offset - query.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		response.Prev = pageLink(path, query, prev)
+	}
+
+	return response
+}
+
+// pageLink links to the page of the listing at offset, keeping the sorting and
+// filters of query.
+func pageLink(path string, query ListQuery, offset int) string {
+	params := query.values()
+	params.Set("limit", strconv.Itoa(query.Limit))
+	params.Set("cursor", encodeCursor(offset))
+
+	return fmt.Sprintf("%s?%s", path, params.Encode())
+}
+
+// Cursors are opaque to clients so the way pages are addressed can change
+// without breaking links.
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("offset:%d", offset)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	offset, err := strconv.Atoi(strings.TrimPrefix(string(decoded), "offset:"))
+	if err != nil || offset < 0 || !strings.HasPrefix(string(decoded), "offset:") {
+		return 0, fmt.Errorf("server: invalid cursor %q", cursor)
+	}
+
+	return offset, nil
+}
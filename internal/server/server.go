@@ -1,12 +1,13 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/jralph/hackernews-api/internal/scraper"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/labstack/echo/v4"
 )
@@ -14,8 +15,10 @@ import (
 type AllItemsResponse []ItemListing
 
 type ItemListing struct {
-	ID       int    `json:"id,omitempty"`
-	Location string `json:"location,omitempty"`
+	Rank     int           `json:"rank,omitempty"`
+	ID       int           `json:"id,omitempty"`
+	Location string        `json:"location,omitempty"`
+	Item     *ItemResponse `json:"item,omitempty"`
 }
 
 type ItemResponse struct {
@@ -32,17 +35,34 @@ type ItemResponse struct {
 	Parts       []*ItemListing `json:"parts,omitempty"`
 	Poll        int            `json:"poll,omitempty"`
 	Parent      *ItemListing   `json:"parent,omitempty"`
+	Author      *UserResponse  `json:"author,omitempty"`
+}
+
+type UserResponse struct {
+	ID      string `json:"id"`
+	Created int    `json:"created,omitempty"`
+	Karma   int    `json:"karma,omitempty"`
+	About   string `json:"about,omitempty"`
+	Items   string `json:"items,omitempty"`
 }
 
 type Storage interface {
-	GetAllItems() ([]int, error)
-	GetAllPosts(*string) ([]int, error)
-	GetItem(int) (*scraper.ItemResponse, error)
-	Cache(string, time.Duration, interface{}, func() interface{}) error
+	GetAllItems(context.Context, ListQuery) (ListResult, error)
+	GetAllPosts(context.Context, *string, ListQuery) (ListResult, error)
+	GetTopStories(context.Context, ListQuery) (ListResult, error)
+	GetFeed(context.Context, scraper.Feed, ListQuery) (ListResult, error)
+	GetItem(context.Context, int) (*scraper.ItemResponse, error)
+	GetItems(context.Context, []int) ([]*scraper.ItemResponse, error)
+	GetUser(context.Context, string) (*scraper.UserResponse, error)
+	Cache(context.Context, string, time.Duration, interface{}, func(context.Context) (interface{}, error)) error
+	Ping(context.Context) error
+	Status(context.Context) (StoreStatus, error)
 }
 
 type Config struct {
-	store Storage
+	store    Storage
+	metrics  *metrics
+	gatherer prometheus.Gatherer
 }
 
 type Option func(*Config)
@@ -55,8 +75,11 @@ func WithStorage(storage Storage) Option {
 
 func CreateServer(opts ...Option) http.Handler {
 	e := echo.New()
+	e.HTTPErrorHandler = errorHandler
 
-	conf := &Config{}
+	conf := &Config{
+		metrics: newMetrics(),
+	}
 
 	for _, opt := range opts {
 		opt(conf)
@@ -66,169 +89,211 @@ func CreateServer(opts ...Option) http.Handler {
 		panic(fmt.Errorf("server: error creating server, must pass `WithStorage` option to CreateServer"))
 	}
 
+	e.Use(conf.metrics.middleware)
+
 	e.GET("/", func(c echo.Context) error {
 		response := map[string]string{
 			"items":   "/items",
 			"posts":   "/posts",
 			"stories": "/stories",
 			"jobs":    "/jobs",
+			"top":     "/top",
+			"feeds":   "/feeds/:feed",
+			"status":  "/status",
 		}
 
 		return c.JSON(http.StatusOK, response)
 	})
 
-	e.GET("/items", func(c echo.Context) error {
-		data := AllItemsResponse{}
-		err := conf.store.Cache("items", time.Minute*5, &data, func() interface{} {
-			response := AllItemsResponse{}
-			items, _ := conf.store.GetAllItems()
-
-			for _, id := range items {
-				response = append(response, ItemListing{
-					ID:       id,
-					Location: fmt.Sprintf("/items/%d", id),
-				})
-			}
+	listItems := conf.listHandler(func(ctx context.Context, params pathParams, query ListQuery) (ListResult, error) {
+		return conf.store.GetAllItems(ctx, query)
+	})
 
-			return &response
-		})
+	if conf.gatherer != nil {
+		e.GET("/metrics", metricsHandler(conf.gatherer))
+	}
 
-		if err != nil {
-			c.Logger().Error(err)
-			return c.String(http.StatusInternalServerError, "")
+	e.GET("/healthz", conf.healthHandler)
+	e.GET("/readyz", conf.readyHandler)
+	e.GET("/status", conf.statusHandler)
+
+	e.GET("/items", func(c echo.Context) error {
+		if _, ok := c.QueryParams()["ids"]; ok {
+			return conf.bulkItemsHandler(c)
 		}
 
-		return c.JSON(http.StatusOK, data)
+		return listItems(c)
 	})
 
-	e.GET("/posts", func(c echo.Context) error {
-		data := AllItemsResponse{}
-		err := conf.store.Cache("posts", time.Minute*5, &data, func() interface{} {
-			response := AllItemsResponse{}
-			items, _ := conf.store.GetAllPosts(nil)
-
-			for _, id := range items {
-				response = append(response, ItemListing{
-					ID:       id,
-					Location: fmt.Sprintf("/items/%d", id),
-				})
-			}
+	e.POST("/items", conf.bulkItemsHandler)
 
-			return &response
-		})
+	e.GET("/posts", conf.listHandler(func(ctx context.Context, params pathParams, query ListQuery) (ListResult, error) {
+		return conf.store.GetAllPosts(ctx, nil, query)
+	}))
 
+	e.GET("/top", conf.feedHandler(func(ctx context.Context, params pathParams, query ListQuery) (ListResult, error) {
+		return conf.store.GetTopStories(ctx, query)
+	}))
+
+	for _, feed := range []scraper.Feed{scraper.FeedNew, scraper.FeedBest, scraper.FeedAsk, scraper.FeedShow} {
+		feed := feed
+		e.GET(fmt.Sprintf("/%s", feed), conf.feedHandler(func(ctx context.Context, params pathParams, query ListQuery) (ListResult, error) {
+			return conf.store.GetFeed(ctx, feed, query)
+		}))
+	}
+
+	e.GET("/feeds/:feed", conf.feedHandler(func(ctx context.Context, params pathParams, query ListQuery) (ListResult, error) {
+		feed, err := scraper.ParseFeed(params["feed"])
 		if err != nil {
-			c.Logger().Error(err)
-			return c.String(http.StatusInternalServerError, "")
+			return ListResult{}, errNotFound
 		}
 
-		return c.JSON(http.StatusOK, data)
-	})
+		return conf.store.GetFeed(ctx, feed, query)
+	}))
 
 	e.GET("/items/:id", func(c echo.Context) error {
-		id, _ := strconv.Atoi(c.Param("id"))
+		ctx := c.Request().Context()
+		id, err := parseItemID(c)
+		if err != nil {
+			return err
+		}
+
+		expand, err := parseExpand(c)
+		if err != nil {
+			return err
+		}
+
+		key := fmt.Sprintf("item/%d", id)
+		if expand != (expandOptions{}) {
+			key = fmt.Sprintf("%s?expand=%s", key, expand)
+		}
 
 		data := &ItemResponse{}
-		err := conf.store.Cache(fmt.Sprintf("item/%d", id), time.Minute*5, data, func() interface{} {
-			savedItem, _ := conf.store.GetItem(id)
+		err = conf.store.Cache(ctx, key, time.Minute*5, data, func(ctx context.Context) (interface{}, error) {
+			savedItem, err := conf.store.GetItem(ctx, id)
+			if err != nil {
+				return nil, err
+			}
 			if savedItem == nil {
-				return c.JSON(http.StatusNotFound, nil)
+				return nil, errNotFound
 			}
-
-			item := &ItemResponse{
-				By:          savedItem.By,
-				Descendants: savedItem.Descendants,
-				ID:          savedItem.ID,
-				Score:       savedItem.Score,
-				Time:        savedItem.Time,
-				Title:       savedItem.Title,
-				Type:        savedItem.Type,
-				URL:         savedItem.URL,
-				Text:        savedItem.Text,
-				Poll:        savedItem.Poll,
+			if savedItem.Deleted || savedItem.Dead {
+				return nil, errGone
 			}
 
-			for _, kidID := range savedItem.Kids {
-				item.Kids = append(item.Kids, &ItemListing{
-					ID:       kidID,
-					Location: fmt.Sprintf("/items/%d", kidID),
-				})
-			}
+			item := newItemResponse(savedItem)
 
-			for _, PartID := range savedItem.Parts {
-				item.Kids = append(item.Kids, &ItemListing{
-					ID:       PartID,
-					Location: fmt.Sprintf("/items/%d", PartID),
-				})
+			err = conf.expandItem(ctx, item, savedItem, expand)
+			if err != nil {
+				return nil, err
 			}
 
-			if savedItem.Parent != 0 {
-				item.Parent = &ItemListing{
-					ID:       savedItem.Parent,
-					Location: fmt.Sprintf("/items/%d", savedItem.Parent),
-				}
-			}
-
-			return &item
+			return item, nil
 		})
 
 		if err != nil {
-			c.Logger().Error(err)
-			return c.String(http.StatusInternalServerError, "")
+			return err
 		}
 
 		return c.JSON(http.StatusOK, data)
 	})
 
-	e.GET("/stories", func(c echo.Context) error {
-		data := AllItemsResponse{}
-		err := conf.store.Cache("stories", time.Minute*5, &data, func() interface{} {
-			response := AllItemsResponse{}
-			postType := "story"
-			items, _ := conf.store.GetAllPosts(&postType)
-
-			for _, id := range items {
-				response = append(response, ItemListing{
-					ID:       id,
-					Location: fmt.Sprintf("/items/%d", id),
-				})
+	e.GET("/items/:id/tree", conf.treeHandler)
+
+	e.GET("/stories", conf.listHandler(func(ctx context.Context, params pathParams, query ListQuery) (ListResult, error) {
+		postType := "story"
+		return conf.store.GetAllPosts(ctx, &postType, query)
+	}))
+
+	e.GET("/jobs", conf.listHandler(func(ctx context.Context, params pathParams, query ListQuery) (ListResult, error) {
+		postType := "job"
+		return conf.store.GetAllPosts(ctx, &postType, query)
+	}))
+
+	e.GET("/users/:id", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		id := c.Param("id")
+
+		data := &UserResponse{}
+		err := conf.store.Cache(ctx, fmt.Sprintf("user/%s", id), time.Minute*5, data, func(ctx context.Context) (interface{}, error) {
+			savedUser, err := conf.store.GetUser(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			if savedUser == nil {
+				return nil, errNotFound
 			}
 
-			return &response
+			return newUserResponse(savedUser), nil
 		})
 
 		if err != nil {
-			c.Logger().Error(err)
-			return c.String(http.StatusInternalServerError, "")
+			return err
 		}
 
 		return c.JSON(http.StatusOK, data)
 	})
 
-	e.GET("/jobs", func(c echo.Context) error {
-		data := AllItemsResponse{}
-		err := conf.store.Cache("jobs", time.Minute*5, &data, func() interface{} {
-			response := AllItemsResponse{}
-			postType := "job"
-			items, _ := conf.store.GetAllPosts(&postType)
-
-			for _, id := range items {
-				response = append(response, ItemListing{
-					ID:       id,
-					Location: fmt.Sprintf("/items/%d", id),
-				})
-			}
+	e.GET("/users/:id/items", conf.orderedHandler(func(ctx context.Context, params pathParams, query ListQuery) (ListResult, error) {
+		savedUser, err := conf.store.GetUser(ctx, params["id"])
+		if err != nil {
+			return ListResult{}, err
+		}
+
+		if savedUser == nil {
+			return ListResult{}, errNotFound
+		}
 
-			return &response
+		return pageIDs(savedUser.Submitted, query), nil
+	}))
+
+	return e
+}
+
+func newItemResponse(savedItem *scraper.ItemResponse) *ItemResponse {
+	item := &ItemResponse{
+		By:          savedItem.By,
+		Descendants: savedItem.Descendants,
+		ID:          savedItem.ID,
+		Score:       savedItem.Score,
+		Time:        savedItem.Time,
+		Title:       savedItem.Title,
+		Type:        savedItem.Type,
+		URL:         savedItem.URL,
+		Text:        savedItem.Text,
+		Poll:        savedItem.Poll,
+	}
+
+	for _, kidID := range savedItem.Kids {
+		item.Kids = append(item.Kids, &ItemListing{
+			ID:       kidID,
+			Location: fmt.Sprintf("/items/%d", kidID),
 		})
+	}
 
-		if err != nil {
-			c.Logger().Error(err)
-			return c.String(http.StatusInternalServerError, "")
+	for _, partID := range savedItem.Parts {
+		item.Parts = append(item.Parts, &ItemListing{
+			ID:       partID,
+			Location: fmt.Sprintf("/items/%d", partID),
+		})
+	}
+
+	if savedItem.Parent != 0 {
+		item.Parent = &ItemListing{
+			ID:       savedItem.Parent,
+			Location: fmt.Sprintf("/items/%d", savedItem.Parent),
 		}
+	}
 
-		return c.JSON(http.StatusOK, data)
-	})
+	return item
+}
 
-	return e
+func newUserResponse(savedUser *scraper.UserResponse) *UserResponse {
+	return &UserResponse{
+		ID:      savedUser.ID,
+		Created: savedUser.Created,
+		Karma:   savedUser.Karma,
+		About:   savedUser.About,
+		Items:   fmt.Sprintf("/users/%s/items", savedUser.ID),
+	}
 }
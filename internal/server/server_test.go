@@ -1,13 +1,20 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jralph/hackernews-api/internal/scraper"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -15,22 +22,82 @@ import (
 
 type MockStorage struct {
 	mock.Mock
+
+	lastQuery ListQuery
+	lastKey   string
+	items     map[int]*scraper.ItemResponse
+	err       error
+	status    StoreStatus
+}
+
+func (m *MockStorage) GetAllItems(ctx context.Context, query ListQuery) (ListResult, error) {
+	return pageIDs([]int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, query), nil
+}
+
+func (m *MockStorage) GetAllPosts(ctx context.Context, postType *string, query ListQuery) (ListResult, error) {
+	m.lastQuery = query
+	return pageIDs([]int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, query), nil
 }
 
-func (m *MockStorage) GetAllItems() ([]int, error) {
-	return []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, nil
+func (m *MockStorage) GetTopStories(ctx context.Context, query ListQuery) (ListResult, error) {
+	return m.GetFeed(ctx, scraper.FeedTop, query)
 }
 
-func (m *MockStorage) GetAllPosts(postType *string) ([]int, error) {
-	return []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, nil
+func (m *MockStorage) GetFeed(ctx context.Context, feed scraper.Feed, query ListQuery) (ListResult, error) {
+	if feed == scraper.FeedAsk {
+		return pageIDs([]int{}, query), nil
+	}
+
+	return pageIDs([]int{30, 10, 20}, query), nil
 }
 
-func (m *MockStorage) GetItem(id int) (*scraper.ItemResponse, error) {
+func (m *MockStorage) GetItem(ctx context.Context, id int) (*scraper.ItemResponse, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	if m.items != nil {
+		return m.items[id], nil
+	}
+
 	return &scraper.ItemResponse{}, nil
 }
 
-func (m *MockStorage) Cache(key string, expireAfter time.Duration, target interface{}, f func() interface{}) error {
-	toCache := f()
+func (m *MockStorage) GetItems(ctx context.Context, ids []int) ([]*scraper.ItemResponse, error) {
+	items := make([]*scraper.ItemResponse, 0, len(ids))
+	for _, id := range ids {
+		item, err := m.GetItem(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func (m *MockStorage) GetUser(ctx context.Context, id string) (*scraper.UserResponse, error) {
+	if id != "exampleuser" {
+		return nil, nil
+	}
+
+	return &scraper.UserResponse{ID: id, Karma: 123, Submitted: []int{1, 2, 3}}, nil
+}
+
+func (m *MockStorage) Ping(ctx context.Context) error {
+	return m.err
+}
+
+func (m *MockStorage) Status(ctx context.Context) (StoreStatus, error) {
+	return m.status, m.err
+}
+
+func (m *MockStorage) Cache(ctx context.Context, key string, expireAfter time.Duration, target interface{}, f func(context.Context) (interface{}, error)) error {
+	m.lastKey = key
+	toCache, err := f(ctx)
+	if err != nil {
+		return err
+	}
 
 	encoded, err := json.Marshal(toCache)
 	if err != nil {
@@ -55,16 +122,693 @@ func TestHTTPServerItemsEndpoint(t *testing.T) {
 	resp := w.Result()
 	body, _ := ioutil.ReadAll(resp.Body)
 
-	var response AllItemsResponse
+	var response ListResponse
 	err := json.Unmarshal(body, &response)
 
 	assert.Equal(t, 200, resp.StatusCode)
 	assert.Equal(t, "application/json; charset=UTF-8", resp.Header.Get("Content-Type"))
 	require.NoError(t, err)
-	assert.Len(t, response, 10)
+	assert.Len(t, response.Items, 10)
+	assert.Equal(t, 10, response.Total)
 
-	for _, item := range response {
+	for _, item := range response.Items {
 		assert.IsType(t, string(""), item.Location)
 		assert.IsType(t, int(0), item.ID)
 	}
 }
+
+func TestHTTPServerUsersEndpoint(t *testing.T) {
+	type test struct {
+		path       string
+		statusCode int
+	}
+
+	tests := map[string]test{
+		"Server returns user":                {path: "/users/exampleuser", statusCode: 200},
+		"Server returns user items":          {path: "/users/exampleuser/items", statusCode: 200},
+		"Server handles missing user":        {path: "/users/missing", statusCode: 404},
+		"Server handles missing users items": {path: "/users/missing/items", statusCode: 404},
+	}
+
+	handler := CreateServer(
+		WithStorage(&MockStorage{}),
+	)
+
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://localhost"+opts.path, nil)
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			resp := w.Result()
+			assert.Equal(t, opts.statusCode, resp.StatusCode)
+		})
+	}
+
+	t.Run("Server returns users submitted items", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost/users/exampleuser/items", nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		body, _ := ioutil.ReadAll(w.Result().Body)
+
+		var response ListResponse
+		err := json.Unmarshal(body, &response)
+
+		require.NoError(t, err)
+		assert.Len(t, response.Items, 3)
+		assert.Equal(t, "/items/1", response.Items[0].Location)
+	})
+}
+
+func TestHTTPServerPagination(t *testing.T) {
+	handler := CreateServer(
+		WithStorage(&MockStorage{}),
+	)
+
+	get := func(t *testing.T, path string) (int, ListResponse) {
+		req := httptest.NewRequest("GET", "http://localhost"+path, nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		var response ListResponse
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		_ = json.Unmarshal(body, &response)
+
+		return w.Result().StatusCode, response
+	}
+
+	t.Run("Server returns requested page", func(t *testing.T) {
+		status, response := get(t, "/items?limit=3&offset=3")
+
+		assert.Equal(t, 200, status)
+		assert.Equal(t, 10, response.Total)
+		assert.Equal(t, 3, response.Offset)
+		require.Len(t, response.Items, 3)
+		assert.Equal(t, 4, response.Items[0].ID)
+		assert.NotEmpty(t, response.Next)
+		assert.NotEmpty(t, response.Prev)
+	})
+
+	t.Run("Server follows next links to the last page", func(t *testing.T) {
+		var ids []int
+		path := "/posts?limit=4"
+		for path != "" {
+			status, response := get(t, path)
+			require.Equal(t, 200, status)
+
+			for _, item := range response.Items {
+				ids = append(ids, item.ID)
+			}
+			path = response.Next
+		}
+
+		assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, ids)
+	})
+
+	t.Run("Server rejects invalid pagination parameters", func(t *testing.T) {
+		for _, path := range []string{"/items?limit=0", "/items?limit=abc", "/items?offset=-1", "/items?cursor=invalid"} {
+			status, _ := get(t, path)
+			assert.Equal(t, 400, status, path)
+		}
+	})
+}
+
+func TestHTTPServerCacheKeys(t *testing.T) {
+	storage := &MockStorage{}
+	handler := CreateServer(
+		WithStorage(storage),
+	)
+
+	key := func(path string) string {
+		req := httptest.NewRequest("GET", "http://localhost"+path, nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Result().StatusCode, path)
+
+		return storage.lastKey
+	}
+
+	t.Run("Server caches equivalent listings under one key", func(t *testing.T) {
+		expected := key("/posts?sort=score&by=exampleuser")
+
+		assert.Equal(t, "posts?by=exampleuser&limit=100&offset=0&sort=score", expected)
+		assert.Equal(t, expected, key("/posts?by=exampleuser&sort=score&order=desc"))
+		assert.Equal(t, expected, key("/posts?sort=score&by=exampleuser&unknown=1"))
+		assert.Equal(t, expected, key("/posts?sort=score&by=exampleuser&limit=100&cursor="+encodeCursor(0)))
+	})
+
+	t.Run("Server caches distinct listings under separate keys", func(t *testing.T) {
+		assert.NotEqual(t, key("/posts?sort=score"), key("/posts?sort=score&order=asc"))
+		assert.NotEqual(t, key("/posts"), key("/stories"))
+	})
+
+	t.Run("Server caches equivalent trees under one key", func(t *testing.T) {
+		expected := key("/items/1/tree")
+
+		assert.Equal(t, "item/1/tree?depth=10&max=500&flat=false", expected)
+		assert.Equal(t, expected, key("/items/1/tree?depth=10&unknown=1"))
+	})
+}
+
+func TestHTTPServerPostFilters(t *testing.T) {
+	storage := &MockStorage{}
+	handler := CreateServer(
+		WithStorage(storage),
+	)
+
+	minScore := 10
+
+	type test struct {
+		path       string
+		statusCode int
+		expected   ListQuery
+	}
+
+	tests := map[string]test{
+		"Server defaults to id order":            {path: "/posts", statusCode: 200, expected: ListQuery{Limit: DefaultLimit}},
+		"Server sorts descending by default":     {path: "/posts?sort=score", statusCode: 200, expected: ListQuery{Limit: DefaultLimit, Sort: SortScore, Desc: true}},
+		"Server sorts in requested order":        {path: "/posts?sort=time&order=asc", statusCode: 200, expected: ListQuery{Limit: DefaultLimit, Sort: SortTime}},
+		"Server parses filters":                  {path: "/posts?by=exampleuser&type=job&min_score=10&since=1000&until=2021-01-01T00:00:00Z", statusCode: 200, expected: ListQuery{Limit: DefaultLimit, By: "exampleuser", Type: "job", MinScore: &minScore, Since: 1000, Until: 1609459200}},
+		"Server rejects unknown sort":            {path: "/posts?sort=unknown", statusCode: 400},
+		"Server rejects unknown order":           {path: "/posts?order=sideways", statusCode: 400},
+		"Server rejects invalid min score":       {path: "/posts?min_score=lots", statusCode: 400},
+		"Server rejects invalid since and until": {path: "/posts?since=yesterday", statusCode: 400},
+		"Server rejects sorting feeds":           {path: "/top?sort=score", statusCode: 400},
+		"Server rejects filtering feeds":         {path: "/feeds/new?by=exampleuser", statusCode: 400},
+		"Server rejects ordering feeds":          {path: "/best?order=desc", statusCode: 400},
+		"Server rejects filtering user items":    {path: "/users/exampleuser/items?min_score=10", statusCode: 400},
+	}
+
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			storage.lastQuery = ListQuery{}
+			req := httptest.NewRequest("GET", "http://localhost"+opts.path, nil)
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, opts.statusCode, w.Result().StatusCode)
+			if opts.statusCode == 200 {
+				assert.Equal(t, opts.expected, storage.lastQuery)
+			}
+		})
+	}
+}
+
+func TestHTTPServerFeeds(t *testing.T) {
+	handler := CreateServer(
+		WithStorage(&MockStorage{}),
+	)
+
+	get := func(path string) (int, ListResponse) {
+		req := httptest.NewRequest("GET", "http://localhost"+path, nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		var response ListResponse
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		_ = json.Unmarshal(body, &response)
+
+		return w.Result().StatusCode, response
+	}
+
+	t.Run("Server returns top stories in rank order", func(t *testing.T) {
+		status, response := get("/top")
+
+		assert.Equal(t, 200, status)
+		assert.Equal(t, AllItemsResponse{
+			{Rank: 1, ID: 30, Location: "/items/30"},
+			{Rank: 2, ID: 10, Location: "/items/10"},
+			{Rank: 3, ID: 20, Location: "/items/20"},
+		}, response.Items)
+	})
+
+	t.Run("Server ranks continue across pages", func(t *testing.T) {
+		status, response := get("/top?limit=1&offset=2")
+
+		assert.Equal(t, 200, status)
+		assert.Equal(t, AllItemsResponse{{Rank: 3, ID: 20, Location: "/items/20"}}, response.Items)
+	})
+
+	t.Run("Server returns other feeds", func(t *testing.T) {
+		for _, path := range []string{"/new", "/best", "/show", "/feeds/job", "/feeds/top"} {
+			status, response := get(path)
+
+			assert.Equal(t, 200, status, path)
+			assert.Len(t, response.Items, 3, path)
+		}
+
+		status, response := get("/ask")
+		assert.Equal(t, 200, status)
+		assert.Len(t, response.Items, 0)
+	})
+
+	t.Run("Server handles unknown feeds", func(t *testing.T) {
+		status, _ := get("/feeds/unknown")
+
+		assert.Equal(t, 404, status)
+	})
+}
+
+func TestHTTPServerItemTree(t *testing.T) {
+	storage := &MockStorage{
+		items: map[int]*scraper.ItemResponse{
+			1: {ID: 1, Type: "story", Kids: []int{2, 3}},
+			2: {ID: 2, Type: "comment", Parent: 1, Kids: []int{4}},
+			3: {ID: 3, Type: "comment", Parent: 1},
+			4: {ID: 4, Type: "comment", Parent: 2, Kids: []int{5, 99}},
+			5: {ID: 5, Type: "comment", Parent: 4},
+		},
+	}
+	handler := CreateServer(
+		WithStorage(storage),
+	)
+
+	get := func(path string) (int, TreeResponse) {
+		req := httptest.NewRequest("GET", "http://localhost"+path, nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		var response TreeResponse
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		_ = json.Unmarshal(body, &response)
+
+		return w.Result().StatusCode, response
+	}
+
+	t.Run("Server returns nested comment tree", func(t *testing.T) {
+		status, response := get("/items/1/tree")
+
+		assert.Equal(t, 200, status)
+		assert.Equal(t, 5, response.Nodes)
+		assert.False(t, response.Truncated)
+		require.Len(t, response.Item.Kids, 2)
+		assert.Equal(t, 2, response.Item.Kids[0].ID)
+		assert.Equal(t, 4, response.Item.Kids[0].Kids[0].ID)
+		assert.Equal(t, 5, response.Item.Kids[0].Kids[0].Kids[0].ID)
+		assert.Equal(t, 3, response.Item.Kids[0].Kids[0].Kids[0].Depth)
+	})
+
+	t.Run("Server limits tree depth", func(t *testing.T) {
+		status, response := get("/items/1/tree?depth=1")
+
+		assert.Equal(t, 200, status)
+		assert.Equal(t, 3, response.Nodes)
+		assert.True(t, response.Truncated)
+		assert.Empty(t, response.Item.Kids[0].Kids)
+		assert.Equal(t, 1, response.Item.Kids[0].More)
+	})
+
+	t.Run("Server limits tree nodes", func(t *testing.T) {
+		status, response := get("/items/1/tree?max=2")
+
+		assert.Equal(t, 200, status)
+		assert.Equal(t, 2, response.Nodes)
+		assert.True(t, response.Truncated)
+		require.Len(t, response.Item.Kids, 1)
+		assert.Equal(t, 1, response.Item.More)
+	})
+
+	t.Run("Server flattens tree into threaded list", func(t *testing.T) {
+		status, response := get("/items/1/tree?flat=true")
+
+		assert.Equal(t, 200, status)
+		assert.Nil(t, response.Item)
+
+		var ids, depths []int
+		for _, item := range response.Items {
+			ids = append(ids, item.ID)
+			depths = append(depths, item.Depth)
+		}
+		assert.Equal(t, []int{1, 2, 4, 5, 3}, ids)
+		assert.Equal(t, []int{0, 1, 2, 3, 1}, depths)
+	})
+
+	t.Run("Server handles missing items and invalid limits", func(t *testing.T) {
+		status, _ := get("/items/999/tree")
+		assert.Equal(t, 404, status)
+
+		status, _ = get("/items/1/tree?depth=-1")
+		assert.Equal(t, 400, status)
+
+		status, _ = get("/items/1/tree?max=0")
+		assert.Equal(t, 400, status)
+	})
+}
+
+func TestHTTPServerItemExpand(t *testing.T) {
+	storage := &MockStorage{
+		items: map[int]*scraper.ItemResponse{
+			1: {ID: 1, Type: "story", Title: "Story"},
+			2: {ID: 2, Type: "poll", By: "exampleuser", Parent: 1, Kids: []int{3, 99}, Parts: []int{4}},
+			3: {ID: 3, Type: "comment", Parent: 2},
+			4: {ID: 4, Type: "pollopt", Poll: 2},
+		},
+	}
+	handler := CreateServer(
+		WithStorage(storage),
+	)
+
+	get := func(path string) (int, ItemResponse) {
+		req := httptest.NewRequest("GET", "http://localhost"+path, nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		var response ItemResponse
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		_ = json.Unmarshal(body, &response)
+
+		return w.Result().StatusCode, response
+	}
+
+	t.Run("Server returns bare references by default", func(t *testing.T) {
+		status, response := get("/items/2")
+
+		assert.Equal(t, 200, status)
+		require.Len(t, response.Kids, 2)
+		require.Len(t, response.Parts, 1)
+		assert.Equal(t, 4, response.Parts[0].ID)
+		assert.Nil(t, response.Kids[0].Item)
+		assert.Nil(t, response.Parts[0].Item)
+		assert.Nil(t, response.Parent.Item)
+		assert.Nil(t, response.Author)
+	})
+
+	t.Run("Server inlines expanded resources", func(t *testing.T) {
+		status, response := get("/items/2?expand=kids,parent,parts,author")
+
+		assert.Equal(t, 200, status)
+		require.Len(t, response.Kids, 2)
+		require.NotNil(t, response.Kids[0].Item)
+		assert.Equal(t, "comment", response.Kids[0].Item.Type)
+		assert.Nil(t, response.Kids[1].Item)
+		require.NotNil(t, response.Parts[0].Item)
+		assert.Equal(t, "pollopt", response.Parts[0].Item.Type)
+		require.NotNil(t, response.Parent.Item)
+		assert.Equal(t, "Story", response.Parent.Item.Title)
+		require.NotNil(t, response.Author)
+		assert.Equal(t, 123, response.Author.Karma)
+	})
+
+	t.Run("Server only inlines requested resources", func(t *testing.T) {
+		_, response := get("/items/2?expand=parent")
+
+		assert.NotNil(t, response.Parent.Item)
+		assert.Nil(t, response.Kids[0].Item)
+		assert.Nil(t, response.Author)
+	})
+
+	t.Run("Server rejects unknown expansions", func(t *testing.T) {
+		status, _ := get("/items/2?expand=kids,comments")
+
+		assert.Equal(t, 400, status)
+	})
+}
+
+func TestHTTPServerBulkItems(t *testing.T) {
+	storage := &MockStorage{
+		items: map[int]*scraper.ItemResponse{
+			1: {ID: 1, Type: "story", Title: "Story"},
+			2: {ID: 2, Type: "comment", Parent: 1},
+			3: {ID: 3, Deleted: true},
+		},
+	}
+	handler := CreateServer(
+		WithStorage(storage),
+	)
+
+	request := func(req *http.Request) (int, BulkItemsResponse) {
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		var response BulkItemsResponse
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		_ = json.Unmarshal(body, &response)
+
+		return w.Result().StatusCode, response
+	}
+
+	t.Run("Server returns requested items in order with not found markers", func(t *testing.T) {
+		status, response := request(httptest.NewRequest("GET", "http://localhost/items?ids=2,99,1", nil))
+
+		assert.Equal(t, 200, status)
+		require.Len(t, response.Items, 3)
+		assert.Equal(t, 2, response.Items[0].ID)
+		assert.Equal(t, "comment", response.Items[0].Item.Type)
+		assert.Equal(t, BulkItem{ID: 99, NotFound: true}, response.Items[1])
+		assert.Equal(t, "Story", response.Items[2].Item.Title)
+	})
+
+	t.Run("Server accepts ids in a POST body", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "http://localhost/items", strings.NewReader(`{"ids":[1,2,3]}`))
+		req.Header.Set("Content-Type", "application/json")
+		status, response := request(req)
+
+		assert.Equal(t, 200, status)
+		require.Len(t, response.Items, 3)
+		assert.Equal(t, 1, response.Items[0].ID)
+		assert.Equal(t, BulkItem{ID: 3, Gone: true}, response.Items[2])
+	})
+
+	t.Run("Server still lists items without ids", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/items?limit=2", nil))
+
+		var response ListResponse
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		require.NoError(t, json.Unmarshal(body, &response))
+		assert.Len(t, response.Items, 2)
+	})
+
+	tooMany := strings.Repeat("1,", MaxBulkItems+1)
+
+	type test struct {
+		method string
+		target string
+		body   string
+	}
+
+	tests := map[string]test{
+		"empty ids":     {method: "GET", target: "/items?ids="},
+		"invalid ids":   {method: "GET", target: "/items?ids=1,abc"},
+		"negative ids":  {method: "GET", target: "/items?ids=-1"},
+		"too many ids":  {method: "GET", target: "/items?ids=" + tooMany},
+		"invalid body":  {method: "POST", target: "/items", body: `{"ids":"1,2"}`},
+		"empty body":    {method: "POST", target: "/items", body: `{}`},
+		"negative body": {method: "POST", target: "/items", body: `{"ids":[0]}`},
+	}
+
+	for name, test := range tests {
+		t.Run(fmt.Sprintf("Server rejects %s", name), func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "http://localhost"+test.target, strings.NewReader(test.body))
+			req.Header.Set("Content-Type", "application/json")
+			status, _ := request(req)
+
+			assert.Equal(t, 400, status)
+		})
+	}
+}
+
+func TestHTTPServerErrors(t *testing.T) {
+	storage := &MockStorage{
+		items: map[int]*scraper.ItemResponse{
+			1: {ID: 1, Type: "story", Kids: []int{2, 3}},
+			2: {ID: 2, Parent: 1, Deleted: true},
+			3: {ID: 3, Parent: 1, Dead: true},
+		},
+	}
+	handler := CreateServer(
+		WithStorage(storage),
+	)
+
+	type test struct {
+		path       string
+		statusCode int
+		message    string
+	}
+
+	tests := map[string]test{
+		"Server rejects invalid item ids":      {path: "/items/abc", statusCode: 400, message: `invalid item id "abc"`},
+		"Server rejects invalid tree ids":      {path: "/items/-1/tree", statusCode: 400, message: `invalid item id "-1"`},
+		"Server rejects invalid limits":        {path: "/posts?limit=0", statusCode: 400, message: "limit must be between 1 and 1000"},
+		"Server handles missing items":         {path: "/items/99", statusCode: 404, message: "not found"},
+		"Server handles missing routes":        {path: "/missing", statusCode: 404, message: "Not Found"},
+		"Server handles deleted items":         {path: "/items/2", statusCode: 410, message: "item has been deleted"},
+		"Server handles dead items":            {path: "/items/3", statusCode: 410, message: "item has been deleted"},
+		"Server handles trees of dead items":   {path: "/items/3/tree", statusCode: 410, message: "item has been deleted"},
+		"Server handles missing user":          {path: "/users/missing", statusCode: 404, message: "not found"},
+		"Server handles unknown feeds":         {path: "/feeds/unknown", statusCode: 404, message: "not found"},
+		"Server handles missing user listings": {path: "/users/missing/items", statusCode: 404, message: "not found"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://localhost"+test.path, nil)
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			var response ErrorResponse
+			body, _ := ioutil.ReadAll(w.Result().Body)
+			require.NoError(t, json.Unmarshal(body, &response))
+
+			assert.Equal(t, test.statusCode, w.Result().StatusCode)
+			assert.Equal(t, ErrorResponse{Error: ErrorDetail{Status: test.statusCode, Message: test.message}}, response)
+		})
+	}
+
+	t.Run("Server leaves deleted replies out of trees", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost/items/1/tree", nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		var response TreeResponse
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		require.NoError(t, json.Unmarshal(body, &response))
+		assert.Equal(t, 1, response.Nodes)
+		assert.Empty(t, response.Item.Kids)
+	})
+
+	type storageTest struct {
+		err        error
+		statusCode int
+		message    string
+	}
+
+	storageTests := map[string]storageTest{
+		"Server reports storage network errors as unavailable": {
+			err:        &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+			statusCode: 503,
+			message:    "storage unavailable",
+		},
+		"Server reports storage timeouts as unavailable": {
+			err:        fmt.Errorf("storage: %w", context.DeadlineExceeded),
+			statusCode: 503,
+			message:    "storage timed out",
+		},
+		"Server reports cancelled requests separately": {
+			err:        context.Canceled,
+			statusCode: 499,
+			message:    "request cancelled",
+		},
+		"Server reports unknown errors as internal errors": {
+			err:        errors.New("unexpected"),
+			statusCode: 500,
+			message:    "internal server error",
+		},
+	}
+
+	for name, test := range storageTests {
+		t.Run(name, func(t *testing.T) {
+			handler := CreateServer(
+				WithStorage(&MockStorage{err: test.err}),
+			)
+
+			for _, path := range []string{"/items/1", "/items/1/tree", "/items?ids=1,2"} {
+				req := httptest.NewRequest("GET", "http://localhost"+path, nil)
+				w := httptest.NewRecorder()
+
+				handler.ServeHTTP(w, req)
+
+				var response ErrorResponse
+				body, _ := ioutil.ReadAll(w.Result().Body)
+				require.NoError(t, json.Unmarshal(body, &response))
+				assert.Equal(t, test.statusCode, w.Result().StatusCode, path)
+				assert.Equal(t, test.message, response.Error.Message, path)
+			}
+		})
+	}
+}
+
+func TestHTTPServerHealth(t *testing.T) {
+	lastScrape := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	type test struct {
+		storage    *MockStorage
+		path       string
+		statusCode int
+	}
+
+	tests := map[string]test{
+		"Server is alive without storage":           {storage: &MockStorage{err: errors.New("down")}, path: "/healthz", statusCode: 200},
+		"Server is not ready without storage":       {storage: &MockStorage{err: errors.New("down")}, path: "/readyz", statusCode: 503},
+		"Server is not ready without data":          {storage: &MockStorage{}, path: "/readyz", statusCode: 503},
+		"Server is ready with data":                 {storage: &MockStorage{status: StoreStatus{Items: 1}}, path: "/readyz", statusCode: 200},
+		"Server reports status":                     {storage: &MockStorage{status: StoreStatus{Items: 1}}, path: "/status", statusCode: 200},
+		"Server cannot report status without store": {storage: &MockStorage{err: errors.New("down")}, path: "/status", statusCode: 503},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			handler := CreateServer(
+				WithStorage(test.storage),
+			)
+
+			req := httptest.NewRequest("GET", "http://localhost"+test.path, nil)
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, test.statusCode, w.Result().StatusCode)
+		})
+	}
+
+	t.Run("Server reports last scrape and item counts", func(t *testing.T) {
+		handler := CreateServer(
+			WithStorage(&MockStorage{status: StoreStatus{
+				LastScrape: lastScrape,
+				Items:      3,
+				Types:      map[string]int{"story": 2, "comment": 1},
+			}}),
+		)
+
+		req := httptest.NewRequest("GET", "http://localhost/status", nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		var response StatusResponse
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		require.NoError(t, json.Unmarshal(body, &response))
+
+		require.NotNil(t, response.LastScrape)
+		assert.True(t, lastScrape.Equal(*response.LastScrape))
+		assert.Equal(t, 3, response.Items)
+		assert.Equal(t, map[string]int{"story": 2, "comment": 1}, response.Types)
+		assert.GreaterOrEqual(t, response.StoreLatencyMS, float64(0))
+	})
+}
+
+func TestHTTPServerMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	handler := CreateServer(
+		WithStorage(&MockStorage{items: map[int]*scraper.ItemResponse{1: {ID: 1}}}),
+		WithMetrics(registry),
+	)
+
+	for _, path := range []string{"/items/1", "/items/2", "/items/abc"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost"+path, nil))
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/metrics", nil)
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	body, _ := ioutil.ReadAll(w.Result().Body)
+
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.Contains(t, string(body), `hn_api_request_duration_seconds_count{method="GET",route="/items/:id",status="200"} 1`)
+	assert.Contains(t, string(body), `hn_api_request_duration_seconds_count{method="GET",route="/items/:id",status="400"} 1`)
+	assert.Contains(t, string(body), `hn_api_request_duration_seconds_count{method="GET",route="/items/:id",status="404"} 1`)
+}
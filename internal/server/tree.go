@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jralph/hackernews-api/internal/scraper"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	DefaultTreeDepth = 10
+	MaxTreeDepth     = 100
+	DefaultTreeNodes = 500
+	MaxTreeNodes     = 5000
+)
+
+// TreeItem is an item along with its nested kids. When the tree is flattened
+// Kids is left empty and Depth marks how deeply the item is nested instead.
+// More counts the kids left out because of the depth or node limits.
+type TreeItem struct {
+	By          string      `json:"by,omitempty"`
+	Descendants int         `json:"descendants,omitempty"`
+	ID          int         `json:"id"`
+	Score       int         `json:"score,omitempty"`
+	Time        int         `json:"time,omitempty"`
+	Title       string      `json:"title,omitempty"`
+	Type        string      `json:"type,omitempty"`
+	URL         string      `json:"url,omitempty"`
+	Text        string      `json:"text,omitempty"`
+	Poll        int         `json:"poll,omitempty"`
+	Parent      int         `json:"parent,omitempty"`
+	Depth       int         `json:"depth"`
+	Kids        []*TreeItem `json:"kids,omitempty"`
+	More        int         `json:"more,omitempty"`
+
+	kidIDs []int
+}
+
+type TreeResponse struct {
+	Item      *TreeItem   `json:"item,omitempty"`
+	Items     []*TreeItem `json:"items,omitempty"`
+	Nodes     int         `json:"nodes"`
+	Truncated bool        `json:"truncated"`
+}
+
+func (conf *Config) treeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	id, err := parseItemID(c)
+	if err != nil {
+		return err
+	}
+
+	depth, err := parseBoundedInt(c, "depth", DefaultTreeDepth, 0, MaxTreeDepth)
+	if err != nil {
+		return err
+	}
+
+	maxNodes, err := parseBoundedInt(c, "max", DefaultTreeNodes, 1, MaxTreeNodes)
+	if err != nil {
+		return err
+	}
+
+	flat := c.QueryParam("flat") == "true"
+
+	data := &TreeResponse{}
+	key := fmt.Sprintf("item/%d/tree?depth=%d&max=%d&flat=%t", id, depth, maxNodes, flat)
+	err = conf.store.Cache(ctx, key, time.Minute*5, data, func(ctx context.Context) (interface{}, error) {
+		root, nodes, truncated, err := conf.buildTree(ctx, id, depth, maxNodes)
+		if err != nil {
+			return nil, err
+		}
+
+		response := &TreeResponse{Item: root, Nodes: nodes, Truncated: truncated}
+		if flat {
+			response.Item = nil
+			response.Items = flattenTree(root, []*TreeItem{})
+		}
+
+		return response, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, data)
+}
+
+// buildTree loads the comment tree below id breadth first, fetching each level
+// in bulk, so that when the node limit is reached the upper levels of the
+// discussion are complete. Deleted and dead replies are left out.
+func (conf *Config) buildTree(ctx context.Context, id int, depth int, maxNodes int) (*TreeItem, int, bool, error) {
+	savedRoot, err := conf.store.GetItem(ctx, id)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if savedRoot == nil {
+		return nil, 0, false, errNotFound
+	}
+	if savedRoot.Deleted || savedRoot.Dead {
+		return nil, 0, false, errGone
+	}
+
+	root := newTreeItem(savedRoot, 0)
+	nodes := 1
+	truncated := false
+
+	level := []*TreeItem{root}
+	for len(level) > 0 {
+		var parents []*TreeItem
+		var ids []int
+
+		for _, parent := range level {
+			if parent.Depth >= depth {
+				parent.More = len(parent.kidIDs)
+				truncated = truncated || parent.More > 0
+				continue
+			}
+
+			for i, kidID := range parent.kidIDs {
+				if nodes+len(ids) >= maxNodes {
+					parent.More = len(parent.kidIDs) - i
+					truncated = true
+					break
+				}
+
+				parents = append(parents, parent)
+				ids = append(ids, kidID)
+			}
+		}
+
+		if len(ids) == 0 {
+			break
+		}
+
+		savedKids, err := conf.store.GetItems(ctx, ids)
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		var next []*TreeItem
+		for i, savedKid := range savedKids {
+			if savedKid == nil || savedKid.Deleted || savedKid.Dead {
+				continue
+			}
+
+			kid := newTreeItem(savedKid, parents[i].Depth+1)
+			parents[i].Kids = append(parents[i].Kids, kid)
+			next = append(next, kid)
+			nodes++
+		}
+
+		level = next
+	}
+
+	return root, nodes, truncated, nil
+}
+
+// flattenTree lists the tree in threaded order, each item followed by its
+// replies.
+func flattenTree(item *TreeItem, items []*TreeItem) []*TreeItem {
+	kids := item.Kids
+	item.Kids = nil
+	items = append(items, item)
+
+	for _, kid := range kids {
+		items = flattenTree(kid, items)
+	}
+
+	return items
+}
+
+func newTreeItem(item *scraper.ItemResponse, depth int) *TreeItem {
+	return &TreeItem{
+		By:          item.By,
+		Descendants: item.Descendants,
+		ID:          item.ID,
+		Score:       item.Score,
+		Time:        item.Time,
+		Title:       item.Title,
+		Type:        item.Type,
+		URL:         item.URL,
+		Text:        item.Text,
+		Poll:        item.Poll,
+		Parent:      item.Parent,
+		Depth:       depth,
+		kidIDs:      append(append([]int{}, item.Kids...), item.Parts...),
+	}
+}
+
+func parseBoundedInt(c echo.Context, name string, defaultValue int, min int, max int) (int, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < min || parsed > max {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s must be between %d and %d", name, min, max))
+	}
+
+	return parsed, nil
+}
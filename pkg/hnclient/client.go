@@ -1,14 +1,17 @@
 package hnclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/jralph/hackernews-api/internal/scraper"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -18,19 +21,21 @@ const (
 type IncorrectHTTPStatusCodeError struct {
 	StatusCode int
 	URL        string
+	Attempts   int
 }
 
 func (e *IncorrectHTTPStatusCodeError) Error() string {
-	return fmt.Sprintf("client: got http status code %d for url %s", e.StatusCode, e.URL)
+	return fmt.Sprintf("client: got http status code %d for url %s after %d attempt(s)", e.StatusCode, e.URL, e.Attempts)
 }
 
 type HTTPResponseError struct {
 	PreviousError error
 	URL           string
+	Attempts      int
 }
 
 func (e *HTTPResponseError) Error() string {
-	return fmt.Sprintf("client: error making http request: %s", e.PreviousError)
+	return fmt.Sprintf("client: error making http request after %d attempt(s): %s", e.Attempts, e.PreviousError)
 }
 
 type HTTPRequestError struct {
@@ -42,6 +47,18 @@ func (e *HTTPRequestError) Error() string {
 	return fmt.Sprintf("client: error creating request for url %s: %s", e.URL, e.PreviousError)
 }
 
+// LimitError is returned when a request could not be made within the rate
+// or in-flight limits of the client, such as when the context is done while
+// waiting. It is never retried.
+type LimitError struct {
+	PreviousError error
+	URL           string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("client: error waiting to make request for url %s: %s", e.URL, e.PreviousError)
+}
+
 type ResponseParseError struct {
 	PreviousError error
 }
@@ -51,8 +68,12 @@ func (e *ResponseParseError) Error() string {
 }
 
 type Client struct {
-	httpClient HTTPClient
-	url        string
+	httpClient  HTTPClient
+	url         string
+	retryPolicy RetryPolicy
+	limiter     *rate.Limiter
+	inFlight    chan struct{}
+	metrics     *metrics
 }
 
 type Option func(*Client)
@@ -69,12 +90,45 @@ func WithAPIBaseURL(url string) Option {
 	}
 }
 
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.retryPolicy = policy
+	}
+}
+
+// WithRateLimit limits the client to perSecond requests per second on
+// average, allowing bursts of up to burst requests. Retried attempts count
+// towards the limit. A perSecond of 0 or less disables the limit, otherwise
+// burst must be at least 1 or every request fails with a LimitError.
+func WithRateLimit(perSecond float64, burst int) Option {
+	return func(c *Client) {
+		c.limiter = nil
+		if perSecond > 0 {
+			c.limiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+		}
+	}
+}
+
+// WithMaxInFlight limits the number of requests the client has open at once,
+// a request stays open until its response body has been read. A max of 0
+// or less disables the limit.
+func WithMaxInFlight(max int) Option {
+	return func(c *Client) {
+		c.inFlight = nil
+		if max > 0 {
+			c.inFlight = make(chan struct{}, max)
+		}
+	}
+}
+
 func NewClient(opts ...Option) *Client {
 	client := &Client{
 		httpClient: &http.Client{
 			Timeout: time.Second * 10,
 		},
-		url: DefaultURL,
+		url:         DefaultURL,
+		retryPolicy: NoRetries,
+		metrics:     newMetrics(),
 	}
 
 	for _, opt := range opts {
@@ -84,23 +138,49 @@ func NewClient(opts ...Option) *Client {
 	return client
 }
 
-func (c *Client) TopStories() (scraper.TopStoriesResponse, error) {
-	resp, err := c.get("/topstories.json")
+func (c *Client) TopStories(ctx context.Context) (scraper.TopStoriesResponse, error) {
+	return c.Feed(ctx, scraper.FeedTop)
+}
+
+func (c *Client) NewStories(ctx context.Context) (scraper.NewStoriesResponse, error) {
+	return c.Feed(ctx, scraper.FeedNew)
+}
+
+func (c *Client) BestStories(ctx context.Context) (scraper.BestStoriesResponse, error) {
+	return c.Feed(ctx, scraper.FeedBest)
+}
+
+func (c *Client) AskStories(ctx context.Context) (scraper.AskStoriesResponse, error) {
+	return c.Feed(ctx, scraper.FeedAsk)
+}
+
+func (c *Client) ShowStories(ctx context.Context) (scraper.ShowStoriesResponse, error) {
+	return c.Feed(ctx, scraper.FeedShow)
+}
+
+func (c *Client) JobStories(ctx context.Context) (scraper.JobStoriesResponse, error) {
+	return c.Feed(ctx, scraper.FeedJob)
+}
+
+// Feed fetches the list of item ids for the given feed, in the order they
+// are ranked on hacker news.
+func (c *Client) Feed(ctx context.Context, feed scraper.Feed) ([]int, error) {
+	resp, err := c.get(ctx, fmt.Sprintf("/%sstories.json", feed))
 	if err != nil {
-		return scraper.TopStoriesResponse{}, err
+		return []int{}, err
 	}
 
-	var topStories scraper.TopStoriesResponse
-	err = c.parse(resp.Body, &topStories)
+	var stories []int
+	err = c.parse(resp.Body, &stories)
 	if err != nil {
-		return scraper.TopStoriesResponse{}, err
+		return []int{}, err
 	}
 
-	return topStories, nil
+	return stories, nil
 }
 
-func (c *Client) Item(id int) (*scraper.ItemResponse, error) {
-	resp, err := c.get(fmt.Sprintf("/item/%d.json", id))
+func (c *Client) Item(ctx context.Context, id int) (*scraper.ItemResponse, error) {
+	resp, err := c.get(ctx, fmt.Sprintf("/item/%d.json", id))
 	if err != nil {
 		return &scraper.ItemResponse{}, err
 	}
@@ -114,34 +194,138 @@ func (c *Client) Item(id int) (*scraper.ItemResponse, error) {
 	return &item, nil
 }
 
-func (c *Client) get(path string) (*http.Response, error) {
+func (c *Client) User(ctx context.Context, id string) (*scraper.UserResponse, error) {
+	resp, err := c.get(ctx, fmt.Sprintf("/user/%s.json", url.PathEscape(id)))
+	if err != nil {
+		return &scraper.UserResponse{}, err
+	}
+
+	var user scraper.UserResponse
+	err = c.parse(resp.Body, &user)
+	if err != nil {
+		return &scraper.UserResponse{}, err
+	}
+
+	return &user, nil
+}
+
+func (c *Client) MaxItem(ctx context.Context) (int, error) {
+	resp, err := c.get(ctx, "/maxitem.json")
+	if err != nil {
+		return 0, err
+	}
+
+	var maxItem int
+	err = c.parse(resp.Body, &maxItem)
+	if err != nil {
+		return 0, err
+	}
+
+	return maxItem, nil
+}
+
+func (c *Client) Updates(ctx context.Context) (*scraper.UpdatesResponse, error) {
+	resp, err := c.get(ctx, "/updates.json")
+	if err != nil {
+		return &scraper.UpdatesResponse{}, err
+	}
+
+	var updates scraper.UpdatesResponse
+	err = c.parse(resp.Body, &updates)
+	if err != nil {
+		return &scraper.UpdatesResponse{}, err
+	}
+
+	return &updates, nil
+}
+
+func (c *Client) get(ctx context.Context, path string) (*http.Response, error) {
 	url := fmt.Sprintf("%s%s", c.url, path)
-	request, err := http.NewRequest("GET", url, nil)
+
+	start := time.Now()
+	defer c.metrics.observeRequest(path, start)
+
+	for attempt := 1; ; attempt++ {
+		resp, err := c.do(ctx, url, attempt)
+		if err == nil {
+			return resp, nil
+		}
+
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+
+		if ctx.Err() != nil || !c.retryPolicy.shouldRetry(attempt, err) {
+			c.metrics.countError(err)
+			return resp, err
+		}
+
+		delay := c.retryPolicy.delay(attempt, resp)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			c.metrics.countError(err)
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, url string, attempt int) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, &HTTPRequestError{PreviousError: err, URL: url}
 	}
 
+	if c.limiter != nil {
+		err := c.limiter.Wait(ctx)
+		if err != nil {
+			return nil, &LimitError{PreviousError: err, URL: url}
+		}
+	}
+
+	release := func() {}
+	if c.inFlight != nil {
+		select {
+		case c.inFlight <- struct{}{}:
+			release = func() { <-c.inFlight }
+		case <-ctx.Done():
+			return nil, &LimitError{PreviousError: ctx.Err(), URL: url}
+		}
+	}
+
 	resp, err := c.httpClient.Do(request)
+	if err != nil || resp.Body == nil {
+		release()
+	} else {
+		resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	}
+
 	if err != nil {
-		return resp, &HTTPResponseError{PreviousError: err, URL: url}
+		return resp, &HTTPResponseError{PreviousError: err, URL: url, Attempts: attempt}
 	}
 
 	if resp.StatusCode != 200 {
-		return resp, &IncorrectHTTPStatusCodeError{StatusCode: resp.StatusCode, URL: url}
+		return resp, &IncorrectHTTPStatusCodeError{StatusCode: resp.StatusCode, URL: url, Attempts: attempt}
 	}
 
 	return resp, nil
 }
 
 func (c *Client) parse(readCloser io.ReadCloser, target interface{}) error {
+	defer readCloser.Close()
+
 	body, err := ioutil.ReadAll(readCloser)
-	if err != nil {
-		return &ResponseParseError{PreviousError: err}
+	if err == nil {
+		err = json.Unmarshal(body, target)
 	}
 
-	err = json.Unmarshal(body, target)
 	if err != nil {
-		return &ResponseParseError{PreviousError: err}
+		parseErr := &ResponseParseError{PreviousError: err}
+		c.metrics.countError(parseErr)
+		return parseErr
 	}
 
 	return nil
@@ -2,6 +2,7 @@ package hnclient
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
@@ -150,7 +151,7 @@ func TestTopStories(t *testing.T) {
 				WithHTTPClient(httpClient),
 				WithAPIBaseURL(opts.url),
 			)
-			stories, err := client.TopStories()
+			stories, err := client.TopStories(context.Background())
 
 			require.IsType(t, scraper.TopStoriesResponse{}, stories)
 			if opts.err != nil {
@@ -218,7 +219,7 @@ func TestItem(t *testing.T) {
 				WithHTTPClient(httpClient),
 				WithAPIBaseURL(opts.url),
 			)
-			item, err := client.Item(opts.id)
+			item, err := client.Item(context.Background(), opts.id)
 
 			require.IsType(t, &scraper.ItemResponse{}, item)
 			if opts.err != nil {
@@ -232,3 +233,92 @@ func TestItem(t *testing.T) {
 		})
 	}
 }
+
+type PathRecordingHTTPClient struct {
+	Paths []string
+}
+
+func (m *PathRecordingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	m.Paths = append(m.Paths, req.URL.Path)
+	return &http.Response{
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte("[1,2,3]"))),
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+func TestFeeds(t *testing.T) {
+	httpClient := &PathRecordingHTTPClient{}
+	client := NewClient(
+		WithHTTPClient(httpClient),
+	)
+
+	tests := map[string]func() ([]int, error){
+		"/v0/topstories.json":  func() ([]int, error) { return client.TopStories(context.Background()) },
+		"/v0/newstories.json":  func() ([]int, error) { return client.NewStories(context.Background()) },
+		"/v0/beststories.json": func() ([]int, error) { return client.BestStories(context.Background()) },
+		"/v0/askstories.json":  func() ([]int, error) { return client.AskStories(context.Background()) },
+		"/v0/showstories.json": func() ([]int, error) { return client.ShowStories(context.Background()) },
+		"/v0/jobstories.json":  func() ([]int, error) { return client.JobStories(context.Background()) },
+	}
+
+	for path, f := range tests {
+		t.Run(path, func(t *testing.T) {
+			stories, err := f()
+
+			require.NoError(t, err)
+			assert.Equal(t, []int{1, 2, 3}, stories)
+			assert.Equal(t, path, httpClient.Paths[len(httpClient.Paths)-1])
+		})
+	}
+}
+
+func TestUser(t *testing.T) {
+	httpClient := &MockHTTPClient{}
+	body, _ := json.Marshal(scraper.UserResponse{ID: "exampleuser", Karma: 123, Submitted: []int{1, 2}})
+	httpClient.DoResponse.Response = &http.Response{
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		StatusCode: http.StatusOK,
+	}
+
+	client := NewClient(
+		WithHTTPClient(httpClient),
+	)
+	user, err := client.User(context.Background(), "exampleuser")
+
+	require.NoError(t, err)
+	assert.Equal(t, &scraper.UserResponse{ID: "exampleuser", Karma: 123, Submitted: []int{1, 2}}, user)
+
+	httpClient.DoResponse.Response = &http.Response{
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(""))),
+		StatusCode: http.StatusNotFound,
+	}
+	_, err = client.User(context.Background(), "missing")
+
+	require.Error(t, err)
+	assert.IsType(t, &IncorrectHTTPStatusCodeError{}, err)
+}
+
+func TestMaxItemAndUpdates(t *testing.T) {
+	httpClient := &MockHTTPClient{}
+	client := NewClient(
+		WithHTTPClient(httpClient),
+	)
+
+	httpClient.DoResponse.Response = &http.Response{
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte("8863"))),
+		StatusCode: http.StatusOK,
+	}
+	maxItem, err := client.MaxItem(context.Background())
+
+	require.NoError(t, err)
+	assert.Equal(t, 8863, maxItem)
+
+	httpClient.DoResponse.Response = &http.Response{
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"items":[1,2],"profiles":["exampleuser"]}`))),
+		StatusCode: http.StatusOK,
+	}
+	updates, err := client.Updates(context.Background())
+
+	require.NoError(t, err)
+	assert.Equal(t, &scraper.UpdatesResponse{Items: []int{1, 2}, Profiles: []string{"exampleuser"}}, updates)
+}
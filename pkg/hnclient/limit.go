@@ -0,0 +1,20 @@
+package hnclient
+
+import (
+	"io"
+	"sync"
+)
+
+// releasingBody releases a slot in the clients in-flight limit once the
+// response body has been closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,110 @@
+package hnclient
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type ConcurrencyHTTPClient struct {
+	current int32
+	max     int32
+}
+
+func (m *ConcurrencyHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	current := atomic.AddInt32(&m.current, 1)
+	for {
+		max := atomic.LoadInt32(&m.max)
+		if current <= max || atomic.CompareAndSwapInt32(&m.max, max, current) {
+			break
+		}
+	}
+
+	time.Sleep(time.Millisecond * 5)
+	atomic.AddInt32(&m.current, -1)
+
+	return &http.Response{
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte("123"))),
+		StatusCode: http.StatusOK,
+	}, nil
+}
+
+func TestMaxInFlight(t *testing.T) {
+	httpClient := &ConcurrencyHTTPClient{}
+	client := NewClient(
+		WithHTTPClient(httpClient),
+		WithMaxInFlight(2),
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.MaxItem(context.Background())
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&httpClient.max))
+	assert.Len(t, client.inFlight, 0)
+}
+
+func TestRateLimit(t *testing.T) {
+	client := NewClient(
+		WithHTTPClient(&SequenceHTTPClient{StatusCodes: []int{200, 200, 200, 200, 200}}),
+		WithRateLimit(100, 1),
+	)
+
+	started := time.Now()
+	for i := 0; i < 5; i++ {
+		_, err := client.MaxItem(context.Background())
+		require.NoError(t, err)
+	}
+
+	assert.GreaterOrEqual(t, int64(time.Since(started)), int64(time.Millisecond*35))
+
+	t.Run("Client stops waiting for the rate limit when context is cancelled", func(t *testing.T) {
+		client := NewClient(
+			WithHTTPClient(&SequenceHTTPClient{StatusCodes: []int{200, 200}}),
+			WithRateLimit(0.001, 1),
+		)
+
+		_, err := client.MaxItem(context.Background())
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		defer cancel()
+
+		_, err = client.MaxItem(ctx)
+		require.Error(t, err)
+		assert.IsType(t, &LimitError{}, err)
+	})
+
+	t.Run("Client does not retry requests that cannot be made within the rate limit", func(t *testing.T) {
+		httpClient := &SequenceHTTPClient{StatusCodes: []int{200}}
+		client := NewClient(
+			WithHTTPClient(httpClient),
+			WithRateLimit(100, 0),
+			WithRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}),
+		)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		_, err := client.MaxItem(ctx)
+		require.Error(t, err)
+		assert.IsType(t, &LimitError{}, err)
+		assert.NoError(t, ctx.Err())
+		assert.Equal(t, 0, httpClient.calls)
+	})
+}
@@ -0,0 +1,74 @@
+package hnclient
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metrics struct {
+	requests *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "hn_client_request_duration_seconds",
+			Help:    "Time taken by requests to the hacker news api, including retried attempts.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"endpoint"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hn_client_errors_total",
+			Help: "Requests to the hacker news api that failed, by type of error.",
+		}, []string{"type"}),
+	}
+}
+
+// WithMetrics registers the latency and error metrics of the client with
+// registerer.
+func WithMetrics(registerer prometheus.Registerer) Option {
+	return func(c *Client) {
+		registerer.MustRegister(c.metrics.requests, c.metrics.errors)
+	}
+}
+
+func (m *metrics) observeRequest(path string, start time.Time) {
+	m.requests.WithLabelValues(endpoint(path)).Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) countError(err error) {
+	m.errors.WithLabelValues(errorType(err)).Inc()
+}
+
+// endpoint groups request paths so that every item and user shares a label.
+func endpoint(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/item/"):
+		return "item"
+	case strings.HasPrefix(path, "/user/"):
+		return "user"
+	case strings.HasSuffix(path, "stories.json"):
+		return "feed"
+	default:
+		return strings.TrimSuffix(strings.TrimPrefix(path, "/"), ".json")
+	}
+}
+
+func errorType(err error) string {
+	switch err.(type) {
+	case *IncorrectHTTPStatusCodeError:
+		return "IncorrectHTTPStatusCodeError"
+	case *HTTPResponseError:
+		return "HTTPResponseError"
+	case *HTTPRequestError:
+		return "HTTPRequestError"
+	case *ResponseParseError:
+		return "ResponseParseError"
+	case *LimitError:
+		return "LimitError"
+	default:
+		return "unknown"
+	}
+}
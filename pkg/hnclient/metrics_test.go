@@ -0,0 +1,44 @@
+package hnclient
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	client := NewClient(
+		WithHTTPClient(&SequenceHTTPClient{StatusCodes: []int{200, 200, 404}}),
+		WithMetrics(registry),
+	)
+
+	_, err := client.MaxItem(context.Background())
+	require.NoError(t, err)
+
+	_, err = client.Updates(context.Background())
+	require.IsType(t, &ResponseParseError{}, err)
+
+	_, err = client.Item(context.Background(), 1)
+	require.IsType(t, &IncorrectHTTPStatusCodeError{}, err)
+
+	t.Run("Client records request latency by endpoint", func(t *testing.T) {
+		assert.Equal(t, 3, testutil.CollectAndCount(client.metrics.requests))
+	})
+
+	t.Run("Client counts errors by type", func(t *testing.T) {
+		assert.Equal(t, float64(1), testutil.ToFloat64(client.metrics.errors.WithLabelValues("ResponseParseError")))
+		assert.Equal(t, float64(1), testutil.ToFloat64(client.metrics.errors.WithLabelValues("IncorrectHTTPStatusCodeError")))
+	})
+
+	t.Run("Client groups paths into endpoints", func(t *testing.T) {
+		assert.Equal(t, "item", endpoint("/item/123.json"))
+		assert.Equal(t, "user", endpoint("/user/pg.json"))
+		assert.Equal(t, "feed", endpoint("/topstories.json"))
+		assert.Equal(t, "maxitem", endpoint("/maxitem.json"))
+	})
+}
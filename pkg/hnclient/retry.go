@@ -0,0 +1,103 @@
+package hnclient
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy configures how requests failing with a network error, a 429 or
+// a 5xx status code are retried. Delays grow exponentially from BaseDelay up
+// to MaxDelay, or without limit if MaxDelay is 0, with up to half of each
+// delay randomised to spread retries out. A Retry-After header sent by the
+// api takes precedence over the calculated delay, but is still capped at
+// MaxDelay.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// NoRetries makes every request exactly once.
+var NoRetries = RetryPolicy{MaxAttempts: 1}
+
+// DefaultRetryPolicy retries a request up to twice, waiting roughly 0.5s and
+// then 1s between attempts.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   time.Millisecond * 500,
+	MaxDelay:    time.Second * 30,
+}
+
+func (p RetryPolicy) shouldRetry(attempt int, err error) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+
+	switch e := err.(type) {
+	case *HTTPResponseError:
+		return true
+	case *IncorrectHTTPStatusCodeError:
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+	}
+
+	return false
+}
+
+func (p RetryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return p.capped(retryAfter)
+		}
+	}
+
+	// Double the delay for each attempt, stopping short of overflowing.
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay > 0 && delay <= math.MaxInt64/2; i++ {
+		delay *= 2
+	}
+	delay = p.capped(delay)
+
+	if delay < 2 {
+		return delay
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+func (p RetryPolicy) capped(delay time.Duration) time.Duration {
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+
+	return delay
+}
+
+// parseRetryAfter parses a Retry-After header given either as a number of
+// seconds or as an http date.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+
+	if date.Before(now) {
+		return 0, true
+	}
+
+	return date.Sub(now), true
+}
@@ -0,0 +1,154 @@
+package hnclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type SequenceHTTPClient struct {
+	StatusCodes []int
+	Errors      []error
+	Headers     []http.Header
+	calls       int
+}
+
+func (m *SequenceHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	call := m.calls
+	m.calls++
+
+	if call < len(m.Errors) && m.Errors[call] != nil {
+		return nil, m.Errors[call]
+	}
+
+	header := http.Header{}
+	if call < len(m.Headers) && m.Headers[call] != nil {
+		header = m.Headers[call]
+	}
+
+	return &http.Response{
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte("123"))),
+		StatusCode: m.StatusCodes[call],
+		Header:     header,
+	}, nil
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    time.Millisecond * 5,
+	}
+
+	type test struct {
+		httpClient       *SequenceHTTPClient
+		err              error
+		expectedAttempts int
+	}
+
+	tests := map[string]test{
+		"Client retries server errors":                 {httpClient: &SequenceHTTPClient{StatusCodes: []int{500, 503, 200}}, expectedAttempts: 3},
+		"Client retries too many requests":             {httpClient: &SequenceHTTPClient{StatusCodes: []int{429, 200}}, expectedAttempts: 2},
+		"Client retries network errors":                {httpClient: &SequenceHTTPClient{StatusCodes: []int{0, 200}, Errors: []error{errors.New("mock: error")}}, expectedAttempts: 2},
+		"Client does not retry client errors":          {httpClient: &SequenceHTTPClient{StatusCodes: []int{404}}, err: &IncorrectHTTPStatusCodeError{}, expectedAttempts: 1},
+		"Client gives up after max attempts":           {httpClient: &SequenceHTTPClient{StatusCodes: []int{500, 500, 500}}, err: &IncorrectHTTPStatusCodeError{}, expectedAttempts: 3},
+		"Client honours retry after header in seconds": {httpClient: &SequenceHTTPClient{StatusCodes: []int{429, 200}, Headers: []http.Header{{"Retry-After": []string{"1"}}}}, expectedAttempts: 2},
+	}
+
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := NewClient(
+				WithHTTPClient(opts.httpClient),
+				WithRetryPolicy(policy),
+			)
+
+			maxItem, err := client.MaxItem(context.Background())
+
+			assert.Equal(t, opts.expectedAttempts, opts.httpClient.calls)
+			if opts.err != nil {
+				require.Error(t, err)
+				require.IsType(t, opts.err, err)
+				assert.Equal(t, opts.expectedAttempts, err.(*IncorrectHTTPStatusCodeError).Attempts)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, 123, maxItem)
+			}
+		})
+	}
+
+	t.Run("Client stops retrying when context is cancelled", func(t *testing.T) {
+		httpClient := &SequenceHTTPClient{StatusCodes: []int{500, 500, 500}}
+		client := NewClient(
+			WithHTTPClient(httpClient),
+			WithRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}),
+		)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		defer cancel()
+
+		_, err := client.MaxItem(ctx)
+
+		require.Error(t, err)
+		assert.Equal(t, 1, httpClient.calls)
+	})
+}
+
+func TestRetryDelay(t *testing.T) {
+	type test struct {
+		policy     RetryPolicy
+		attempt    int
+		retryAfter string
+		min        time.Duration
+		max        time.Duration
+	}
+
+	tests := map[string]test{
+		"Delays double on each attempt":               {policy: RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}, attempt: 3, min: time.Second * 2, max: time.Second * 4},
+		"Delays are capped at the max delay":          {policy: RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Second * 5}, attempt: 10, min: time.Millisecond * 2500, max: time.Second * 5},
+		"Delays are uncapped without a max delay":     {policy: RetryPolicy{BaseDelay: time.Second}, attempt: 10, min: time.Second * 256, max: time.Second * 512},
+		"Delays do not overflow":                      {policy: RetryPolicy{BaseDelay: time.Second}, attempt: 100, min: math.MaxInt64 / 4, max: math.MaxInt64},
+		"Retry after headers set the delay":           {policy: RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}, attempt: 1, retryAfter: "10", min: time.Second * 10, max: time.Second * 10},
+		"Retry after headers are capped":              {policy: RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}, attempt: 1, retryAfter: "3600", min: time.Minute, max: time.Minute},
+		"Retry after headers are uncapped by default": {policy: RetryPolicy{BaseDelay: time.Second}, attempt: 1, retryAfter: "3600", min: time.Hour, max: time.Hour},
+	}
+
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if opts.retryAfter != "" {
+				resp.Header.Set("Retry-After", opts.retryAfter)
+			}
+
+			delay := opts.policy.delay(opts.attempt, resp)
+
+			assert.GreaterOrEqual(t, int64(delay), int64(opts.min))
+			assert.LessOrEqual(t, int64(delay), int64(opts.max))
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	delay, ok := parseRetryAfter("120", now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute*2, delay)
+
+	delay, ok = parseRetryAfter("Fri, 01 Jan 2021 12:00:30 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Second*30, delay)
+
+	_, ok = parseRetryAfter("", now)
+	assert.False(t, ok)
+
+	_, ok = parseRetryAfter("invalid", now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,1235 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jralph/hackernews-api/internal/scraper"
+	"github.com/jralph/hackernews-api/internal/server"
+	"go.etcd.io/bbolt"
+)
+
+// boltLockTimeout is how long to wait for another process to release the
+// database file.
+const boltLockTimeout = time.Second * 10
+
+// Buckets of the bolt store. Items, users and feeds are stored as json, and
+// scrape state as decimal text. Which items are listed is tracked in index
+// buckets keyed by item id, and the score, time and descendants of every
+// listed item in sort buckets keyed by that value then the item id.
+var (
+	itemsBucket = []byte("items")
+	usersBucket = []byte("users")
+	feedsBucket = []byte("feeds")
+	metaBucket  = []byte("meta")
+
+	itemsIndexBucket = []byte("index_items")
+	postsIndexBucket = []byte("index_posts")
+
+	maxItemMeta    = []byte("max_item")
+	lastScrapeMeta = []byte("last_scrape")
+	generationMeta = []byte("generation")
+)
+
+// sortFields are the fields with a sort bucket, in the order their values are
+// held in the items index.
+var sortFields = []string{server.SortScore, server.SortTime, server.SortDescendants}
+
+func typeIndexBucket(itemType string) []byte {
+	return []byte("index_type_" + itemType)
+}
+
+func authorIndexBucket(by string) []byte {
+	return []byte("index_by_" + by)
+}
+
+func sortIndexBucket(sort string) []byte {
+	return []byte("index_sort_" + sort)
+}
+
+// Bolt stores everything in a single file on disk, for hosts that do not run
+// redis. The file is held open and locked for the life of the store, so only
+// one process can use it at a time: to serve the api from a file the scraper
+// is writing to, serve it from the scraper process. Cached responses are kept
+// in process.
+type Bolt struct {
+	db    *bbolt.DB
+	cache *localCache
+}
+
+// NewBoltStore opens the bolt store in the file at path, creating it if it does
+// not exist. If another process has the file open, NewBoltStore waits for it to
+// be closed for up to boltLockTimeout.
+func NewBoltStore(path string, opts ...Option) (*Bolt, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: boltLockTimeout})
+	if err == bbolt.ErrTimeout {
+		return nil, fmt.Errorf("storage: %s is in use by another process, such as a scraper running as a daemon, which can serve the api itself with -api-addr", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bolt{
+		db:    db,
+		cache: newLocalCache(newOptions(opts...)),
+	}
+
+	err = b.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{itemsBucket, usersBucket, feedsBucket, metaBucket, itemsIndexBucket, postsIndexBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Files written before the indexes were counted are counted once.
+		if tx.Bucket(metaBucket).Get(indexCountMeta(itemsIndexBucket)) == nil {
+			return countIndexes(tx)
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Close closes the file, releasing it for other processes.
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+func (b *Bolt) SaveTopStories(ctx context.Context, topStories scraper.TopStoriesResponse) error {
+	return b.SaveFeed(ctx, scraper.FeedTop, topStories)
+}
+
+func (b *Bolt) SaveFeed(ctx context.Context, feed scraper.Feed, items []int) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return putFeed(tx, feed, items)
+	})
+}
+
+func (b *Bolt) GetTopStories(ctx context.Context, query server.ListQuery) (server.ListResult, error) {
+	return b.GetFeed(ctx, scraper.FeedTop, query)
+}
+
+func (b *Bolt) GetFeed(ctx context.Context, feed scraper.Feed, query server.ListQuery) (server.ListResult, error) {
+	var ids []int
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		ids, err = getFeed(tx, feed)
+		return err
+	})
+	if err != nil {
+		return server.ListResult{IDs: []int{}}, err
+	}
+
+	return server.ListResult{IDs: page(ids, query), Total: len(ids)}, nil
+}
+
+func (b *Bolt) SaveItem(ctx context.Context, item *scraper.ItemResponse) error {
+	return b.SaveItems(ctx, []*scraper.ItemResponse{item})
+}
+
+// SaveItems stores and reindexes a batch of items in a single transaction, so
+// the file is only synced once however many items there are.
+func (b *Bolt) SaveItems(ctx context.Context, items []*scraper.ItemResponse) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	data := make([][]byte, len(items))
+	for i, item := range items {
+		var err error
+		data[i], err = json.Marshal(item)
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		for i, item := range items {
+			err := putItem(tx, item.ID, data[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (b *Bolt) DeleteItem(ctx context.Context, item *scraper.ItemResponse) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		data, err := tombstone(tx, item)
+		if err != nil {
+			return err
+		}
+
+		return putItem(tx, item.ID, data)
+	})
+}
+
+func (b *Bolt) SaveUser(ctx context.Context, user *scraper.UserResponse) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return putValue(tx.Bucket(usersBucket), []byte(user.ID), data)
+	})
+}
+
+func (b *Bolt) GetUser(ctx context.Context, id string) (*scraper.UserResponse, error) {
+	var user *scraper.UserResponse
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(usersBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+
+		user = &scraper.UserResponse{}
+		return json.Unmarshal(data, user)
+	})
+
+	return user, err
+}
+
+func (b *Bolt) SaveMaxItem(ctx context.Context, id int) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return putValue(tx.Bucket(metaBucket), maxItemMeta, []byte(strconv.Itoa(id)))
+	})
+}
+
+func (b *Bolt) LastMaxItem(ctx context.Context) (int, error) {
+	var id int64
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		id, err = getMeta(tx, maxItemMeta)
+		return err
+	})
+
+	return int(id), err
+}
+
+func (b *Bolt) SaveLastScrape(ctx context.Context, at time.Time) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		err := putValue(tx.Bucket(metaBucket), lastScrapeMeta, []byte(strconv.FormatInt(at.Unix(), 10)))
+		if err != nil {
+			return err
+		}
+
+		return bumpGeneration(tx)
+	})
+}
+
+func (b *Bolt) Ping(ctx context.Context) error {
+	return b.db.View(func(tx *bbolt.Tx) error {
+		return nil
+	})
+}
+
+func (b *Bolt) Status(ctx context.Context) (server.StoreStatus, error) {
+	status := server.StoreStatus{Types: map[string]int{}}
+
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		lastScrape, err := getMeta(tx, lastScrapeMeta)
+		if err != nil {
+			return err
+		}
+		if lastScrape != 0 {
+			status.LastScrape = time.Unix(lastScrape, 0)
+		}
+
+		items, err := getMeta(tx, indexCountMeta(itemsIndexBucket))
+		if err != nil {
+			return err
+		}
+		status.Items = int(items)
+
+		for _, itemType := range itemTypes {
+			count, err := getMeta(tx, indexCountMeta(typeIndexBucket(itemType)))
+			if err != nil {
+				return err
+			}
+			status.Types[itemType] = int(count)
+		}
+
+		return nil
+	})
+
+	return status, err
+}
+
+func (b *Bolt) GetAllItems(ctx context.Context, query server.ListQuery) (server.ListResult, error) {
+	return b.query(itemsIndexBucket, query)
+}
+
+func (b *Bolt) GetAllPosts(ctx context.Context, postType *string, query server.ListQuery) (server.ListResult, error) {
+	if postType != nil {
+		return b.query(typeIndexBucket(*postType), query)
+	}
+
+	return b.query(postsIndexBucket, query)
+}
+
+func (b *Bolt) GetItem(ctx context.Context, id int) (*scraper.ItemResponse, error) {
+	items, err := b.GetItems(ctx, []int{id})
+	if err != nil {
+		return nil, err
+	}
+
+	return items[0], nil
+}
+
+// GetItems reads every item in a single transaction.
+func (b *Bolt) GetItems(ctx context.Context, ids []int) ([]*scraper.ItemResponse, error) {
+	items := make([]*scraper.ItemResponse, len(ids))
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		for i, id := range ids {
+			item, err := getItem(tx, id)
+			if err != nil {
+				return err
+			}
+			items[i] = item
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// Cache generates the value if the data generation cannot be read.
+func (b *Bolt) Cache(ctx context.Context, key string, duration time.Duration, target interface{}, f func(context.Context) (interface{}, error)) error {
+	var generation int64
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		generation, err = getMeta(tx, generationMeta)
+		return err
+	})
+	if err != nil {
+		generation = -1
+	}
+
+	return b.cache.get(ctx, key, generation, duration, target, f)
+}
+
+// query lists the members of the index bucket base matching the filters of
+// query, in the requested order. Members are read in order from the bucket of
+// the sort field, seeking to the start of any range on that field, and the
+// remaining filters checked against the index buckets.
+func (b *Bolt) query(base []byte, query server.ListQuery) (server.ListResult, error) {
+	result := server.ListResult{IDs: []int{}}
+
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		baseIndex := tx.Bucket(base)
+		if baseIndex == nil {
+			return nil
+		}
+
+		sortIndex := baseIndex
+		if query.Sort != server.SortID {
+			sortIndex = tx.Bucket(sortIndexBucket(query.Sort))
+			if sortIndex == nil {
+				return nil
+			}
+		}
+
+		var filters []*bbolt.Bucket
+		if sortIndex != baseIndex {
+			filters = append(filters, baseIndex)
+		}
+		for _, name := range filterBuckets(base, query) {
+			filter := tx.Bucket(name)
+			if filter == nil {
+				return nil
+			}
+			filters = append(filters, filter)
+		}
+
+		lower, upper := int64(-1<<63), int64(1<<63-1)
+		var ranges []valueRange
+		for _, valueRange := range queryRanges(query) {
+			if valueRange.field == query.Sort {
+				lower, upper = valueRange.min, valueRange.max
+				continue
+			}
+			ranges = append(ranges, valueRange)
+		}
+
+		values := tx.Bucket(itemsIndexBucket)
+		cursor := newIndexCursor(sortIndex.Cursor(), query.Sort != server.SortID, query.Desc, lower, upper)
+		for id, ok, err := cursor.first(); ok || err != nil; id, ok, err = cursor.next() {
+			if err != nil {
+				return err
+			}
+
+			if !matchesFilters(id, filters) || !matchesRanges(values.Get(idKey(id)), ranges) {
+				continue
+			}
+
+			if result.Total >= query.Offset && (query.Limit <= 0 || len(result.IDs) < query.Limit) {
+				result.IDs = append(result.IDs, id)
+			}
+			result.Total++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return server.ListResult{IDs: []int{}}, err
+	}
+
+	return result, nil
+}
+
+// filterBuckets are the index buckets a listed item must also be in.
+func filterBuckets(base []byte, query server.ListQuery) [][]byte {
+	var filters [][]byte
+	if query.Type != "" && !bytes.Equal(typeIndexBucket(query.Type), base) {
+		filters = append(filters, typeIndexBucket(query.Type))
+	}
+	if query.By != "" {
+		filters = append(filters, authorIndexBucket(query.By))
+	}
+
+	return filters
+}
+
+func matchesFilters(id int, filters []*bbolt.Bucket) bool {
+	key := idKey(id)
+	for _, filter := range filters {
+		found, _ := filter.Cursor().Seek(key)
+		if !bytes.Equal(found, key) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type valueRange struct {
+	field string
+	min   int64
+	max   int64
+}
+
+func queryRanges(query server.ListQuery) []valueRange {
+	var ranges []valueRange
+	if query.MinScore != nil {
+		ranges = append(ranges, valueRange{field: server.SortScore, min: int64(*query.MinScore), max: 1<<63 - 1})
+	}
+	if query.Since != 0 || query.Until != 0 {
+		timeRange := valueRange{field: server.SortTime, min: -1 << 63, max: 1<<63 - 1}
+		if query.Since != 0 {
+			timeRange.min = int64(query.Since)
+		}
+		if query.Until != 0 {
+			timeRange.max = int64(query.Until)
+		}
+		ranges = append(ranges, timeRange)
+	}
+
+	return ranges
+}
+
+// matchesRanges checks the sort values held in the items index for an item
+// against ranges.
+func matchesRanges(values []byte, ranges []valueRange) bool {
+	for _, valueRange := range ranges {
+		for i, field := range sortFields {
+			if field != valueRange.field {
+				continue
+			}
+
+			value := decodeValue(values[i*8 : i*8+8])
+			if value < valueRange.min || value > valueRange.max {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// indexCursor walks the ids in an index bucket in either direction. Sort
+// buckets are only walked between lower and upper.
+type indexCursor struct {
+	cursor *bbolt.Cursor
+	sorted bool
+	desc   bool
+	lower  int64
+	upper  int64
+}
+
+func newIndexCursor(cursor *bbolt.Cursor, sorted bool, desc bool, lower int64, upper int64) *indexCursor {
+	return &indexCursor{cursor: cursor, sorted: sorted, desc: desc, lower: lower, upper: upper}
+}
+
+func (c *indexCursor) first() (int, bool, error) {
+	var key []byte
+	switch {
+	case !c.sorted && c.desc:
+		key, _ = c.cursor.Last()
+	case !c.sorted:
+		key, _ = c.cursor.First()
+	case c.desc && c.upper == 1<<63-1:
+		key, _ = c.cursor.Last()
+	case c.desc:
+		// Seek past every key with the upper value, then step back.
+		key, _ = c.cursor.Seek(encodeValue(c.upper + 1))
+		if key == nil {
+			key, _ = c.cursor.Last()
+		} else {
+			key, _ = c.cursor.Prev()
+		}
+	default:
+		key, _ = c.cursor.Seek(encodeValue(c.lower))
+	}
+
+	return c.parse(key)
+}
+
+func (c *indexCursor) next() (int, bool, error) {
+	var key []byte
+	if c.desc {
+		key, _ = c.cursor.Prev()
+	} else {
+		key, _ = c.cursor.Next()
+	}
+
+	return c.parse(key)
+}
+
+func (c *indexCursor) parse(key []byte) (int, bool, error) {
+	if key == nil {
+		return 0, false, nil
+	}
+
+	if !c.sorted {
+		return int(binary.BigEndian.Uint64(key)), true, nil
+	}
+
+	value := decodeValue(key[:8])
+	if value < c.lower || value > c.upper {
+		return 0, false, nil
+	}
+
+	id, err := strconv.Atoi(string(key[8:]))
+	if err != nil {
+		return 0, false, err
+	}
+
+	return id, true, nil
+}
+
+// idKey orders item ids numerically.
+func idKey(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+
+	return key
+}
+
+// sortKey orders items by value, then by the text of their id as redis does.
+func sortKey(value int, id int) []byte {
+	return append(encodeValue(int64(value)), strconv.Itoa(id)...)
+}
+
+// encodeValue orders signed values, by flipping the sign bit so negative
+// values sort first.
+func encodeValue(value int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(value)^1<<63)
+
+	return key
+}
+
+func decodeValue(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key) ^ 1<<63)
+}
+
+func getItem(tx *bbolt.Tx, id int) (*scraper.ItemResponse, error) {
+	return parseItem(string(tx.Bucket(itemsBucket).Get(idKey(id))))
+}
+
+// putItem stores data as the item with the given id, or removes the item if
+// data is empty, reindexing it in place of the stored item.
+func putItem(tx *bbolt.Tx, id int, data []byte) error {
+	stored, err := getItem(tx, id)
+	if err != nil {
+		return err
+	}
+	if stored != nil {
+		err = removeFromBoltIndexes(tx, stored)
+		if err != nil {
+			return err
+		}
+	}
+
+	item, err := parseItem(string(data))
+	if err != nil {
+		return err
+	}
+	if item != nil {
+		err = addToBoltIndexes(tx, item)
+		if err != nil {
+			return err
+		}
+	}
+
+	return putValue(tx.Bucket(itemsBucket), idKey(id), data)
+}
+
+// tombstone builds the tombstone replacing item, keeping the parent of the
+// stored item.
+func tombstone(tx *bbolt.Tx, item *scraper.ItemResponse) ([]byte, error) {
+	stored, err := getItem(tx, item.ID)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		stored = item
+	}
+
+	return json.Marshal(newTombstone(item, stored))
+}
+
+func addToBoltIndexes(tx *bbolt.Tx, item *scraper.ItemResponse) error {
+	// Tombstones of deleted and dead items are never listed.
+	if item.Deleted || item.Dead {
+		return nil
+	}
+
+	sortValues := sortValues(item)
+	var values []byte
+	for _, field := range sortFields {
+		values = append(values, encodeValue(int64(sortValues[field]))...)
+	}
+
+	err := putIndex(tx, itemsIndexBucket, tx.Bucket(itemsIndexBucket), idKey(item.ID), values)
+	if err != nil {
+		return err
+	}
+
+	var names [][]byte
+	if item.Type != "" {
+		names = append(names, typeIndexBucket(item.Type))
+	}
+	if postTypes[item.Type] {
+		names = append(names, postsIndexBucket)
+	}
+	if item.By != "" {
+		names = append(names, authorIndexBucket(item.By))
+	}
+
+	for _, name := range names {
+		bucket, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+
+		err = putIndex(tx, name, bucket, idKey(item.ID), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, field := range sortFields {
+		bucket, err := tx.CreateBucketIfNotExists(sortIndexBucket(field))
+		if err != nil {
+			return err
+		}
+
+		err = bucket.Put(sortKey(sortValues[field], item.ID), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func removeFromBoltIndexes(tx *bbolt.Tx, item *scraper.ItemResponse) error {
+	names := [][]byte{itemsIndexBucket, postsIndexBucket, typeIndexBucket(item.Type), authorIndexBucket(item.By)}
+	for _, name := range names {
+		if bucket := tx.Bucket(name); bucket != nil {
+			err := deleteIndex(tx, name, bucket, idKey(item.ID))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	sortValues := sortValues(item)
+	for _, field := range sortFields {
+		if bucket := tx.Bucket(sortIndexBucket(field)); bucket != nil {
+			err := bucket.Delete(sortKey(sortValues[field], item.ID))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// indexCountMeta is the meta key counting the items in the index bucket
+// name, so that Status does not walk the index. The items index and the
+// type indexes are counted.
+func indexCountMeta(name []byte) []byte {
+	return append([]byte("count_"), name...)
+}
+
+func counted(name []byte) bool {
+	return bytes.Equal(name, itemsIndexBucket) || bytes.HasPrefix(name, typeIndexBucket(""))
+}
+
+// putIndex adds key to the index bucket name, counting it if it is new.
+func putIndex(tx *bbolt.Tx, name []byte, bucket *bbolt.Bucket, key []byte, value []byte) error {
+	if counted(name) && !hasKey(bucket, key) {
+		err := addToCount(tx, name, 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return bucket.Put(key, value)
+}
+
+// deleteIndex removes key from the index bucket name, counting it if it was
+// there.
+func deleteIndex(tx *bbolt.Tx, name []byte, bucket *bbolt.Bucket, key []byte) error {
+	if counted(name) && hasKey(bucket, key) {
+		err := addToCount(tx, name, -1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return bucket.Delete(key)
+}
+
+func addToCount(tx *bbolt.Tx, name []byte, delta int64) error {
+	count, err := getMeta(tx, indexCountMeta(name))
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(metaBucket).Put(indexCountMeta(name), []byte(strconv.FormatInt(count+delta, 10)))
+}
+
+// countIndexes counts the counted indexes by walking them.
+func countIndexes(tx *bbolt.Tx) error {
+	names := [][]byte{itemsIndexBucket}
+	for _, itemType := range itemTypes {
+		names = append(names, typeIndexBucket(itemType))
+	}
+
+	for _, name := range names {
+		count := 0
+		if bucket := tx.Bucket(name); bucket != nil {
+			count = bucket.Stats().KeyN
+		}
+
+		err := tx.Bucket(metaBucket).Put(indexCountMeta(name), []byte(strconv.Itoa(count)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasKey reports whether key is in bucket, even with an empty value.
+func hasKey(bucket *bbolt.Bucket, key []byte) bool {
+	found, _ := bucket.Cursor().Seek(key)
+
+	return bytes.Equal(found, key)
+}
+
+func getFeed(tx *bbolt.Tx, feed scraper.Feed) ([]int, error) {
+	data := tx.Bucket(feedsBucket).Get([]byte(feed))
+	if len(data) == 0 {
+		return []int{}, nil
+	}
+
+	var ids []int
+	err := json.Unmarshal(data, &ids)
+
+	return ids, err
+}
+
+// putFeed stores ids as the feed, or removes the feed if there are none.
+func putFeed(tx *bbolt.Tx, feed scraper.Feed, ids []int) error {
+	if len(ids) == 0 {
+		return tx.Bucket(feedsBucket).Delete([]byte(feed))
+	}
+
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(feedsBucket).Put([]byte(feed), data)
+}
+
+// putValue stores value under key, or removes key if value is empty.
+func putValue(bucket *bbolt.Bucket, key []byte, value []byte) error {
+	if len(value) == 0 {
+		return bucket.Delete(key)
+	}
+
+	return bucket.Put(key, value)
+}
+
+func getMeta(tx *bbolt.Tx, key []byte) (int64, error) {
+	data := tx.Bucket(metaBucket).Get(key)
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+func bumpGeneration(tx *bbolt.Tx) error {
+	generation, err := getMeta(tx, generationMeta)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(metaBucket).Put(generationMeta, []byte(strconv.FormatInt(generation+1, 10)))
+}
+
+// previousSnapshot holds the data replaced by the last committed snapshot,
+// so that it can be rolled back.
+const previousSnapshot = "previous"
+
+func snapshotBucket(id string) []byte {
+	return []byte("snapshot_" + id)
+}
+
+// boltSnapshot stages writes in its own bucket until it is committed. The
+// staged changes are held in items, users, feeds and meta buckets nested in
+// the snapshot bucket, with empty values for anything that should be removed.
+type boltSnapshot struct {
+	b  *Bolt
+	id string
+}
+
+// Snapshot stages writes in a bucket of the file.
+func (b *Bolt) Snapshot(ctx context.Context) (scraper.Snapshot, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltSnapshot{b: b, id: id}, nil
+}
+
+func (s *boltSnapshot) SaveFeed(ctx context.Context, feed scraper.Feed, items []int) error {
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+
+	return s.stage(feedsBucket, []byte(feed), data)
+}
+
+func (s *boltSnapshot) SaveItem(ctx context.Context, item *scraper.ItemResponse) error {
+	return s.SaveItems(ctx, []*scraper.ItemResponse{item})
+}
+
+// SaveItems stages a batch of items in a single transaction.
+func (s *boltSnapshot) SaveItems(ctx context.Context, items []*scraper.ItemResponse) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	data := make([][]byte, len(items))
+	for i, item := range items {
+		var err error
+		data[i], err = json.Marshal(item)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.stageAll(itemsBucket, func(bucket *bbolt.Bucket) error {
+		for i, item := range items {
+			err := bucket.Put(idKey(item.ID), data[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *boltSnapshot) DeleteItem(ctx context.Context, item *scraper.ItemResponse) error {
+	data, err := json.Marshal(newTombstone(item, item))
+	if err != nil {
+		return err
+	}
+
+	return s.stage(itemsBucket, idKey(item.ID), data)
+}
+
+func (s *boltSnapshot) SaveUser(ctx context.Context, user *scraper.UserResponse) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	return s.stage(usersBucket, []byte(user.ID), data)
+}
+
+func (s *boltSnapshot) LastMaxItem(ctx context.Context) (int, error) {
+	var id int64
+	staged := false
+	err := s.b.db.View(func(tx *bbolt.Tx) error {
+		changes, err := readChangeSet(tx, snapshotBucket(s.id))
+		if err != nil || changes == nil || changes.maxItem == nil {
+			return err
+		}
+
+		id, staged = int64(*changes.maxItem), true
+		return nil
+	})
+	if err != nil || staged {
+		return int(id), err
+	}
+
+	return s.b.LastMaxItem(ctx)
+}
+
+func (s *boltSnapshot) SaveMaxItem(ctx context.Context, id int) error {
+	return s.stage(metaBucket, maxItemMeta, []byte(strconv.Itoa(id)))
+}
+
+func (s *boltSnapshot) SaveLastScrape(ctx context.Context, at time.Time) error {
+	return s.stage(metaBucket, lastScrapeMeta, []byte(strconv.FormatInt(at.Unix(), 10)))
+}
+
+// Commit publishes every staged write in a single transaction.
+func (s *boltSnapshot) Commit(ctx context.Context) error {
+	return s.b.db.Update(func(tx *bbolt.Tx) error {
+		return promote(tx, snapshotBucket(s.id))
+	})
+}
+
+func (s *boltSnapshot) Discard(ctx context.Context) error {
+	return s.b.db.Update(func(tx *bbolt.Tx) error {
+		return deleteBucket(tx, snapshotBucket(s.id))
+	})
+}
+
+func (s *boltSnapshot) stage(name []byte, key []byte, value []byte) error {
+	return s.stageAll(name, func(bucket *bbolt.Bucket) error {
+		return bucket.Put(key, value)
+	})
+}
+
+// stageAll calls f with the bucket name nested in the snapshot bucket, in a
+// single transaction.
+func (s *boltSnapshot) stageAll(name []byte, f func(*bbolt.Bucket) error) error {
+	return s.b.db.Update(func(tx *bbolt.Tx) error {
+		snapshot, err := tx.CreateBucketIfNotExists(snapshotBucket(s.id))
+		if err != nil {
+			return err
+		}
+
+		bucket, err := snapshot.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+
+		return f(bucket)
+	})
+}
+
+func (b *Bolt) Rollback(ctx context.Context) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(snapshotBucket(previousSnapshot)) == nil {
+			return errNoPreviousSnapshot
+		}
+
+		return promote(tx, snapshotBucket(previousSnapshot))
+	})
+}
+
+// promote applies the changes staged in the named snapshot bucket to the live
+// data, saving the values they replace as the previous snapshot.
+func promote(tx *bbolt.Tx, name []byte) error {
+	changes, err := readChangeSet(tx, name)
+	if err != nil {
+		return err
+	}
+	if changes == nil || changes.empty() {
+		// Keep the previous snapshot rather than replacing it with nothing.
+		return deleteBucket(tx, name)
+	}
+
+	previous := newChangeSet()
+
+	for id, data := range changes.items {
+		previous.items[id] = copyValue(tx.Bucket(itemsBucket).Get(idKey(id)))
+
+		item, err := parseItem(string(data))
+		if err != nil {
+			return err
+		}
+
+		// Tombstones keep the parent of the item they replace.
+		if item != nil && (item.Deleted || item.Dead) {
+			data, err = tombstone(tx, item)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = putItem(tx, id, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	for id, data := range changes.users {
+		previous.users[id] = copyValue(tx.Bucket(usersBucket).Get([]byte(id)))
+
+		err = putValue(tx.Bucket(usersBucket), []byte(id), data)
+		if err != nil {
+			return err
+		}
+	}
+
+	for feed, ids := range changes.feeds {
+		previous.feeds[feed], err = getFeed(tx, feed)
+		if err != nil {
+			return err
+		}
+
+		err = putFeed(tx, feed, ids)
+		if err != nil {
+			return err
+		}
+	}
+
+	if changes.maxItem != nil {
+		maxItem, err := getMeta(tx, maxItemMeta)
+		if err != nil {
+			return err
+		}
+		previous.maxItem = intPointer(int(maxItem))
+
+		err = putMeta(tx, maxItemMeta, int64(*changes.maxItem))
+		if err != nil {
+			return err
+		}
+	}
+
+	if changes.lastScrape != nil {
+		lastScrape, err := getMeta(tx, lastScrapeMeta)
+		if err != nil {
+			return err
+		}
+		previous.lastScrape = &lastScrape
+
+		err = putMeta(tx, lastScrapeMeta, *changes.lastScrape)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = deleteBucket(tx, name)
+	if err != nil {
+		return err
+	}
+
+	err = deleteBucket(tx, snapshotBucket(previousSnapshot))
+	if err != nil {
+		return err
+	}
+
+	err = writeChangeSet(tx, snapshotBucket(previousSnapshot), previous)
+	if err != nil {
+		return err
+	}
+
+	return bumpGeneration(tx)
+}
+
+// readChangeSet reads the changes held in the named snapshot bucket, or nil
+// if there is no such bucket.
+func readChangeSet(tx *bbolt.Tx, name []byte) (*changeSet, error) {
+	snapshot := tx.Bucket(name)
+	if snapshot == nil {
+		return nil, nil
+	}
+
+	changes := newChangeSet()
+
+	err := forEach(snapshot.Bucket(itemsBucket), func(key []byte, value []byte) error {
+		changes.items[int(binary.BigEndian.Uint64(key))] = copyValue(value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = forEach(snapshot.Bucket(usersBucket), func(key []byte, value []byte) error {
+		changes.users[string(key)] = copyValue(value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = forEach(snapshot.Bucket(feedsBucket), func(key []byte, value []byte) error {
+		feed, err := scraper.ParseFeed(string(key))
+		if err != nil {
+			return err
+		}
+
+		var ids []int
+		err = json.Unmarshal(value, &ids)
+		changes.feeds[feed] = ids
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = forEach(snapshot.Bucket(metaBucket), func(key []byte, value []byte) error {
+		parsed, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case bytes.Equal(key, maxItemMeta):
+			changes.maxItem = intPointer(int(parsed))
+		case bytes.Equal(key, lastScrapeMeta):
+			changes.lastScrape = &parsed
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+func writeChangeSet(tx *bbolt.Tx, name []byte, changes *changeSet) error {
+	snapshot, err := tx.CreateBucket(name)
+	if err != nil {
+		return err
+	}
+
+	buckets := map[string]*bbolt.Bucket{}
+	for _, bucketName := range [][]byte{itemsBucket, usersBucket, feedsBucket, metaBucket} {
+		buckets[string(bucketName)], err = snapshot.CreateBucket(bucketName)
+		if err != nil {
+			return err
+		}
+	}
+
+	for id, data := range changes.items {
+		err = buckets[string(itemsBucket)].Put(idKey(id), append([]byte{}, data...))
+		if err != nil {
+			return err
+		}
+	}
+
+	for id, data := range changes.users {
+		err = buckets[string(usersBucket)].Put([]byte(id), append([]byte{}, data...))
+		if err != nil {
+			return err
+		}
+	}
+
+	for feed, ids := range changes.feeds {
+		data, err := json.Marshal(ids)
+		if err != nil {
+			return err
+		}
+
+		err = buckets[string(feedsBucket)].Put([]byte(feed), data)
+		if err != nil {
+			return err
+		}
+	}
+
+	if changes.maxItem != nil {
+		err = buckets[string(metaBucket)].Put(maxItemMeta, []byte(strconv.Itoa(*changes.maxItem)))
+		if err != nil {
+			return err
+		}
+	}
+
+	if changes.lastScrape != nil {
+		err = buckets[string(metaBucket)].Put(lastScrapeMeta, []byte(strconv.FormatInt(*changes.lastScrape, 10)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func deleteBucket(tx *bbolt.Tx, name []byte) error {
+	err := tx.DeleteBucket(name)
+	if err == bbolt.ErrBucketNotFound {
+		return nil
+	}
+
+	return err
+}
+
+func forEach(bucket *bbolt.Bucket, f func([]byte, []byte) error) error {
+	if bucket == nil {
+		return nil
+	}
+
+	return bucket.ForEach(f)
+}
+
+// copyValue copies a value read in a transaction so it can be used after it,
+// returning nil for empty values.
+func copyValue(value []byte) []byte {
+	if len(value) == 0 {
+		return nil
+	}
+
+	return append([]byte{}, value...)
+}
+
+// putMeta stores a meta value, removing it if zero.
+func putMeta(tx *bbolt.Tx, key []byte, value int64) error {
+	if value == 0 {
+		return tx.Bucket(metaBucket).Delete(key)
+	}
+
+	return tx.Bucket(metaBucket).Put(key, []byte(strconv.FormatInt(value, 10)))
+}
+
+func intPointer(value int) *int {
+	return &value
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/jralph/hackernews-api/internal/scraper"
+	"github.com/jralph/hackernews-api/internal/server"
+	"github.com/jralph/hackernews-api/pkg/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+func newTestBoltStore(t *testing.T) (*Bolt, string) {
+	path := filepath.Join(t.TempDir(), "hackernews.db")
+
+	store, err := NewBoltStore(path)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		store.Close()
+	})
+
+	return store, path
+}
+
+func TestBoltConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Store {
+		store, _ := newTestBoltStore(t)
+		return store
+	})
+}
+
+func TestBoltPersistence(t *testing.T) {
+	ctx := context.Background()
+	store, path := newTestBoltStore(t)
+
+	require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 1, Type: "story", By: "alice", Score: 10}))
+	require.NoError(t, store.SaveFeed(ctx, scraper.FeedTop, []int{1}))
+	require.NoError(t, store.SaveMaxItem(ctx, 1))
+
+	t.Run("Batches of items are saved and indexed", func(t *testing.T) {
+		require.NoError(t, store.SaveItems(ctx, []*scraper.ItemResponse{
+			{ID: 2, Type: "comment", By: "bob", Parent: 1},
+			{ID: 3, Type: "comment", By: "carol", Parent: 1},
+		}))
+
+		result, err := store.GetAllItems(ctx, server.ListQuery{Type: "comment"})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{2, 3}, Total: 2}, result)
+	})
+
+	t.Run("Items moved between authors are reindexed", func(t *testing.T) {
+		require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 1, Type: "story", By: "bob"}))
+
+		result, err := store.GetAllItems(ctx, server.ListQuery{By: "alice"})
+		require.NoError(t, err)
+		assert.Empty(t, result.IDs)
+	})
+
+	t.Run("Data is kept when the store is reopened", func(t *testing.T) {
+		require.NoError(t, store.Close())
+
+		reopened, err := NewBoltStore(path)
+		require.NoError(t, err)
+		defer reopened.Close()
+
+		item, err := reopened.GetItem(ctx, 1)
+		require.NoError(t, err)
+		assert.Equal(t, "bob", item.By)
+
+		result, err := reopened.GetAllPosts(ctx, nil, server.ListQuery{Sort: server.SortScore, By: "bob"})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{1}, Total: 1}, result)
+
+		maxItem, err := reopened.LastMaxItem(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, maxItem)
+	})
+}
+
+func TestBoltStatus(t *testing.T) {
+	ctx := context.Background()
+	store, path := newTestBoltStore(t)
+
+	require.NoError(t, store.SaveItems(ctx, []*scraper.ItemResponse{
+		{ID: 1, Type: "story"},
+		{ID: 2, Type: "comment", Parent: 1},
+		{ID: 3, Type: "comment", Parent: 1},
+	}))
+	require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 3, Type: "comment", Parent: 1, Score: 1}))
+	require.NoError(t, store.DeleteItem(ctx, &scraper.ItemResponse{ID: 2, Deleted: true}))
+
+	assertCounts := func(t *testing.T, store *Bolt) {
+		status, err := store.Status(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 2, status.Items)
+		assert.Equal(t, 1, status.Types["story"])
+		assert.Equal(t, 1, status.Types["comment"])
+		assert.Equal(t, 0, status.Types["job"])
+	}
+
+	t.Run("Items are counted as they are indexed", func(t *testing.T) {
+		assertCounts(t, store)
+	})
+
+	t.Run("Batches of items are staged in snapshots", func(t *testing.T) {
+		snapshot, err := store.Snapshot(ctx)
+		require.NoError(t, err)
+		require.NoError(t, snapshot.(scraper.ItemsSaver).SaveItems(ctx, []*scraper.ItemResponse{
+			{ID: 4, Type: "job"},
+			{ID: 5, Type: "job"},
+		}))
+
+		item, err := store.GetItem(ctx, 4)
+		require.NoError(t, err)
+		assert.Nil(t, item)
+
+		require.NoError(t, snapshot.Commit(ctx))
+
+		status, err := store.Status(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 4, status.Items)
+		assert.Equal(t, 2, status.Types["job"])
+
+		require.NoError(t, store.Rollback(ctx))
+		assertCounts(t, store)
+	})
+
+	t.Run("Files written before items were counted are counted when opened", func(t *testing.T) {
+		require.NoError(t, store.db.Update(func(tx *bbolt.Tx) error {
+			cursor := tx.Bucket(metaBucket).Cursor()
+			for key, _ := cursor.Seek([]byte("count_")); bytes.HasPrefix(key, []byte("count_")); key, _ = cursor.Seek([]byte("count_")) {
+				err := cursor.Delete()
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}))
+		require.NoError(t, store.Close())
+
+		reopened, err := NewBoltStore(path)
+		require.NoError(t, err)
+		defer reopened.Close()
+
+		assertCounts(t, reopened)
+	})
+}
+
+func TestBoltQueryRanges(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newTestBoltStore(t)
+
+	for id := 1; id <= 20; id++ {
+		require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: id, Type: "story", Score: id % 5, Time: id * 100}))
+	}
+	require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 21, Type: "story", Score: -3, Time: 2100}))
+
+	minScore := 4
+
+	type test struct {
+		query    server.ListQuery
+		expected server.ListResult
+	}
+
+	tests := map[string]test{
+		"Time range ascending":           {query: server.ListQuery{Sort: server.SortTime, Since: 500, Until: 800}, expected: server.ListResult{IDs: []int{5, 6, 7, 8}, Total: 4}},
+		"Time range descending":          {query: server.ListQuery{Sort: server.SortTime, Desc: true, Since: 500, Until: 800}, expected: server.ListResult{IDs: []int{8, 7, 6, 5}, Total: 4}},
+		"Time range past the last item":  {query: server.ListQuery{Sort: server.SortTime, Desc: true, Since: 1900, Until: 5000}, expected: server.ListResult{IDs: []int{21, 20, 19}, Total: 3}},
+		"Min score sorted by score":      {query: server.ListQuery{Sort: server.SortScore, Desc: true, MinScore: &minScore}, expected: server.ListResult{IDs: []int{9, 4, 19, 14}, Total: 4}},
+		"Min score paginated by time":    {query: server.ListQuery{Sort: server.SortTime, MinScore: &minScore, Offset: 1, Limit: 2}, expected: server.ListResult{IDs: []int{9, 14}, Total: 4}},
+		"Negative scores are sorted low": {query: server.ListQuery{Sort: server.SortScore, Limit: 2}, expected: server.ListResult{IDs: []int{21, 10}, Total: 21}},
+	}
+
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := store.GetAllPosts(ctx, nil, opts.query)
+
+			require.NoError(t, err)
+			assert.Equal(t, opts.expected, result)
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// cacheLockTTL is how long a replica may hold the lock to regenerate a
+	// cached value before another replica can take over.
+	cacheLockTTL = time.Second * 10
+
+	// cacheLockPoll is how often a replica waiting on another replica's lock
+	// checks whether the value has been cached.
+	cacheLockPoll = time.Millisecond * 50
+
+	// cacheGenerateTimeout bounds the time spent generating a value.
+	cacheGenerateTimeout = time.Second * 30
+)
+
+// releaseLockScript deletes a lock only if it is still held with the given
+// token, so a lock that expired and was taken by another replica is left
+// alone.
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// cacheEntry is a cached value along with when it should be regenerated.
+// Entries are kept in redis for the stale period past FreshUntil, so they can
+// be served while being regenerated. Generation is the data generation the
+// value was built from, entries from older generations are treated as expired.
+type cacheEntry struct {
+	Data       json.RawMessage `json:"data"`
+	FreshUntil int64           `json:"fresh_until"`
+	Generation int64           `json:"generation"`
+}
+
+func (e *cacheEntry) fresh(generation int64) bool {
+	return e.Generation >= generation && time.Now().UnixNano() < e.FreshUntil
+}
+
+// stale reports whether the entry has expired but was built from the current
+// data, so can still be served while it is regenerated. Entries built from
+// older data are never served, so new data shows up straight away.
+func (e *cacheEntry) stale(generation int64) bool {
+	return e.Generation >= generation && time.Now().UnixNano() >= e.FreshUntil
+}
+
+// Cache coalesces concurrent misses across replicas as well, through a lock in
+// redis.
+func (r *Redis) Cache(ctx context.Context, key string, duration time.Duration, target interface{}, f func(context.Context) (interface{}, error)) error {
+	entry, generation, err := r.getCacheEntry(ctx, key)
+	if err == nil && entry != nil {
+		if entry.fresh(generation) {
+			r.metrics.cache.WithLabelValues("hit").Inc()
+			return json.Unmarshal(entry.Data, target)
+		}
+
+		if r.staleFor > 0 && entry.stale(generation) {
+			r.metrics.cache.WithLabelValues("stale").Inc()
+			r.flights.start(cacheRefreshKey(key), func(ctx context.Context) ([]byte, error) {
+				return r.generate(ctx, key, duration, f, generation, false)
+			})
+
+			return json.Unmarshal(entry.Data, target)
+		}
+	}
+
+	// If cache hit error, unmarshal error, or no cache hit, generate and cache
+	r.metrics.cache.WithLabelValues("miss").Inc()
+
+	data, err := r.flights.do(ctx, key, func(ctx context.Context) ([]byte, error) {
+		return r.generate(ctx, key, duration, f, generation, true)
+	})
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, target)
+}
+
+// generate caches the value returned by f under key, as of the given data
+// generation, while holding a lock in redis. If another replica holds the lock
+// and wait is set, generate waits for that replica to cache the value instead.
+// Without wait, generate gives up if the lock is held.
+func (r *Redis) generate(ctx context.Context, key string, duration time.Duration, f func(context.Context) (interface{}, error), generation int64, wait bool) ([]byte, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	locked, err := r.client.SetNX(ctx, cacheLockKey(key), token, cacheLockTTL).Result()
+	if err == nil && !locked {
+		if !wait {
+			return nil, nil
+		}
+
+		entry, err := r.waitForCacheEntry(ctx, key, generation)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			return entry.Data, nil
+		}
+	}
+	if locked {
+		// The lock is released even if the generation was cancelled, so other
+		// replicas don't wait for it to expire.
+		defer releaseLockScript.Run(context.Background(), r.client, []string{cacheLockKey(key)}, token)
+	}
+
+	value, err := f(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(&cacheEntry{
+		Data:       data,
+		FreshUntil: time.Now().Add(duration).UnixNano(),
+		Generation: generation,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.client.Set(ctx, key, encoded, duration+r.staleFor).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// waitForCacheEntry polls for the value another replica is generating, from
+// at least the given data generation. A nil entry is returned if the lock is
+// released or expires without the value being cached, in which case the
+// caller should generate it.
+func (r *Redis) waitForCacheEntry(ctx context.Context, key string, generation int64) (*cacheEntry, error) {
+	ticker := time.NewTicker(cacheLockPoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+
+		entry, _, err := r.getCacheEntry(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil && entry.Generation >= generation {
+			return entry, nil
+		}
+
+		held, err := r.client.Exists(ctx, cacheLockKey(key)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if held == 0 {
+			return nil, nil
+		}
+	}
+}
+
+// getCacheEntry fetches the entry cached under key along with the current
+// data generation. A nil entry is returned if there is none or it is not in
+// the expected format.
+func (r *Redis) getCacheEntry(ctx context.Context, key string) (*cacheEntry, int64, error) {
+	var cached *redis.StringCmd
+	var generation *redis.StringCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		cached = pipe.Get(ctx, key)
+		generation = pipe.Get(ctx, generationKey)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, 0, err
+	}
+
+	current, err := generation.Int64()
+	if err != nil && err != redis.Nil {
+		return nil, 0, err
+	}
+
+	data, err := cached.Bytes()
+	if err == redis.Nil {
+		return nil, current, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var entry cacheEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil || entry.Data == nil {
+		return nil, current, nil
+	}
+
+	return &entry, current, nil
+}
+
+func cacheLockKey(key string) string {
+	return "hn_cache_lock_" + key
+}
+
+func cacheRefreshKey(key string) string {
+	return "refresh_" + key
+}
+
+func randomToken() (string, error) {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token), nil
+}
+
+// flightGroup coalesces concurrent generations of the same key, like
+// singleflight. A value is generated on behalf of every request waiting on it,
+// so is not tied to the context of the request that started it, but the
+// generation is cancelled once every waiting request has gone.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a single generation of a value.
+type flight struct {
+	waiters int
+	cancel  context.CancelFunc
+	done    chan struct{}
+	data    []byte
+	err     error
+}
+
+// do generates the value for key with f, sharing the result with concurrent
+// callers for the same key. If ctx is done first the caller stops waiting, and
+// the generation is cancelled if no other caller is still waiting on it.
+func (g *flightGroup) do(ctx context.Context, key string, f func(context.Context) ([]byte, error)) ([]byte, error) {
+	fl := g.join(key, f)
+
+	select {
+	case <-fl.done:
+		return fl.data, fl.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		fl.waiters--
+		last := fl.waiters == 0
+		if last && g.flights[key] == fl {
+			delete(g.flights, key)
+		}
+		g.mu.Unlock()
+
+		if last {
+			fl.cancel()
+		}
+
+		return nil, ctx.Err()
+	}
+}
+
+// start generates the value for key with f in the background, unless it is
+// already being generated. Nothing waits on a background generation, so it
+// runs until it finishes or times out.
+func (g *flightGroup) start(key string, f func(context.Context) ([]byte, error)) {
+	g.join(key, f)
+}
+
+// join counts the caller as waiting on the generation of key, starting it with
+// f if it isn't already running.
+func (g *flightGroup) join(key string, f func(context.Context) ([]byte, error)) *flight {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if fl, ok := g.flights[key]; ok {
+		fl.waiters++
+		return fl
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cacheGenerateTimeout)
+	fl := &flight{waiters: 1, cancel: cancel, done: make(chan struct{})}
+
+	if g.flights == nil {
+		g.flights = map[string]*flight{}
+	}
+	g.flights[key] = fl
+
+	go func() {
+		defer cancel()
+
+		fl.data, fl.err = f(ctx)
+
+		g.mu.Lock()
+		if g.flights[key] == fl {
+			delete(g.flights, key)
+		}
+		g.mu.Unlock()
+
+		close(fl.done)
+	}()
+
+	return fl
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jralph/hackernews-api/internal/scraper"
+	"github.com/jralph/hackernews-api/internal/server"
+)
+
+// keyPrefix starts every key. Items, users, feeds and counters are only ever
+// read or written one key per command, so have no hash tag and spread across
+// the slots of a redis cluster.
+const keyPrefix = "hn_"
+
+// indexKeyPrefix starts the indexes and the sorted sets built from them for
+// queries. Queries intersect several of them with ZINTERSTORE, so they share
+// the {hn_index} hash tag to map to the same slot of a redis cluster.
+const indexKeyPrefix = "{hn_index}_"
+
+var (
+	itemTypes = []string{"story", "job", "poll", "comment", "pollopt"}
+	postTypes = map[string]bool{"story": true, "job": true, "poll": true}
+)
+
+// keyspace names the keys holding one generation of the data. Snapshots stage
+// their writes in a new generation, which readers switch to when it is
+// committed. The generation written before snapshots existed has no name, so
+// its keys are the ones older versions used.
+type keyspace struct {
+	name string
+}
+
+func (k keyspace) prefix() string {
+	if k.name == "" {
+		return keyPrefix
+	}
+
+	return keyPrefix + k.name + "_"
+}
+
+func (k keyspace) indexPrefix() string {
+	if k.name == "" {
+		return indexKeyPrefix
+	}
+
+	return fmt.Sprintf("{hn_index_%s}_", k.name)
+}
+
+// item is the key an item is stored under. Which items exist, and of which
+// type or author, is tracked in sorted set indexes scored by item id. The
+// score, time and descendants of every item are tracked in sorted sets scored
+// by that field, to support sorting and range filters.
+func (k keyspace) item(id int) string {
+	return fmt.Sprintf("%sitem_%d", k.prefix(), id)
+}
+
+func (k keyspace) feed(feed scraper.Feed) string {
+	return fmt.Sprintf("%s%s_stories", k.prefix(), feed)
+}
+
+func (k keyspace) user(id string) string {
+	return fmt.Sprintf("%suser_%s", k.prefix(), id)
+}
+
+func (k keyspace) maxItem() string {
+	return k.prefix() + "max_item"
+}
+
+func (k keyspace) lastScrape() string {
+	return k.prefix() + "last_scrape"
+}
+
+// writes counts the writes made to the keyspace, so that committing a
+// snapshot can tell whether the data it was copied from has changed since.
+func (k keyspace) writes() string {
+	return k.prefix() + "writes"
+}
+
+func (k keyspace) itemsIndex() string {
+	return k.indexPrefix() + "items"
+}
+
+func (k keyspace) postsIndex() string {
+	return k.indexPrefix() + "posts"
+}
+
+func (k keyspace) typeIndex(itemType string) string {
+	return fmt.Sprintf("%stype_%s", k.indexPrefix(), itemType)
+}
+
+func (k keyspace) authorIndex(by string) string {
+	return fmt.Sprintf("%sby_%s", k.indexPrefix(), by)
+}
+
+func (k keyspace) sortIndex(sort string) string {
+	return fmt.Sprintf("%ssort_%s", k.indexPrefix(), sort)
+}
+
+func sortValues(item *scraper.ItemResponse) map[string]int {
+	return map[string]int{
+		server.SortScore:       item.Score,
+		server.SortTime:        item.Time,
+		server.SortDescendants: item.Descendants,
+	}
+}
+
+func addToIndexes(ctx context.Context, pipe redis.Pipeliner, keys keyspace, item *scraper.ItemResponse) {
+	// Tombstones of deleted and dead items are never listed.
+	if item.Deleted || item.Dead {
+		return
+	}
+
+	member := &redis.Z{Score: float64(item.ID), Member: item.ID}
+	pipe.ZAdd(ctx, keys.itemsIndex(), member)
+	if item.Type != "" {
+		pipe.ZAdd(ctx, keys.typeIndex(item.Type), member)
+	}
+	if postTypes[item.Type] {
+		pipe.ZAdd(ctx, keys.postsIndex(), member)
+	}
+	if item.By != "" {
+		pipe.ZAdd(ctx, keys.authorIndex(item.By), member)
+	}
+
+	for sort, value := range sortValues(item) {
+		pipe.ZAdd(ctx, keys.sortIndex(sort), &redis.Z{Score: float64(value), Member: item.ID})
+	}
+}
+
+func removeFromIndexes(ctx context.Context, pipe redis.Pipeliner, keys keyspace, item *scraper.ItemResponse) {
+	pipe.ZRem(ctx, keys.postsIndex(), item.ID)
+	for _, itemType := range itemTypes {
+		pipe.ZRem(ctx, keys.typeIndex(itemType), item.ID)
+	}
+	if item.By != "" {
+		pipe.ZRem(ctx, keys.authorIndex(item.By), item.ID)
+	}
+
+	for sort := range sortValues(item) {
+		pipe.ZRem(ctx, keys.sortIndex(sort), item.ID)
+	}
+}
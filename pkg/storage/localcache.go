@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// defaultCacheSize is the number of values cached in process unless set with
+// WithCacheSize.
+const defaultCacheSize = 10000
+
+// localCache caches values in process, for stores that have nowhere shared to
+// keep them. Stores pass in their current data generation on each lookup, so
+// values built from older data are treated as expired. Once size values are
+// cached the least recently used is dropped for each new one.
+type localCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	recent  *list.List
+	size    int
+
+	metrics  *metrics
+	staleFor time.Duration
+	flights  flightGroup
+}
+
+// localCacheEntry is a cached value along with when it should be dropped,
+// once the stale period has passed.
+type localCacheEntry struct {
+	cacheEntry
+	key     string
+	expires time.Time
+}
+
+func newLocalCache(o *options) *localCache {
+	return &localCache{
+		entries:  map[string]*list.Element{},
+		recent:   list.New(),
+		size:     o.cacheSize,
+		metrics:  o.metrics,
+		staleFor: o.staleFor,
+	}
+}
+
+// get implements Store.Cache for stores caching in process, treating values
+// built before the given data generation as expired.
+func (c *localCache) get(ctx context.Context, key string, generation int64, duration time.Duration, target interface{}, f func(context.Context) (interface{}, error)) error {
+	entry := c.entry(key)
+	if entry != nil {
+		if entry.fresh(generation) {
+			c.metrics.cache.WithLabelValues("hit").Inc()
+			return json.Unmarshal(entry.Data, target)
+		}
+
+		if c.staleFor > 0 && entry.stale(generation) {
+			c.metrics.cache.WithLabelValues("stale").Inc()
+			c.flights.start(cacheRefreshKey(key), func(ctx context.Context) ([]byte, error) {
+				return c.generate(ctx, key, duration, f, generation)
+			})
+
+			return json.Unmarshal(entry.Data, target)
+		}
+	}
+
+	c.metrics.cache.WithLabelValues("miss").Inc()
+
+	data, err := c.flights.do(ctx, key, func(ctx context.Context) ([]byte, error) {
+		return c.generate(ctx, key, duration, f, generation)
+	})
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, target)
+}
+
+// generate caches the value returned by f under key, as of the given data
+// generation, dropping the least recently used value if the cache is full.
+func (c *localCache) generate(ctx context.Context, key string, duration time.Duration, f func(context.Context) (interface{}, error), generation int64) ([]byte, error) {
+	value, err := f(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	entry := &localCacheEntry{
+		cacheEntry: cacheEntry{
+			Data:       data,
+			FreshUntil: now.Add(duration).UnixNano(),
+			Generation: generation,
+		},
+		key:     key,
+		expires: now.Add(duration + c.staleFor),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.recent.MoveToFront(element)
+
+		return data, nil
+	}
+
+	for c.size > 0 && c.recent.Len() >= c.size {
+		c.remove(c.recent.Back())
+	}
+
+	c.entries[key] = c.recent.PushFront(entry)
+
+	return data, nil
+}
+
+// entry fetches the entry cached under key, or nil if there is none or it has
+// expired. Expired entries are dropped.
+func (c *localCache) entry(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := element.Value.(*localCacheEntry)
+	if !time.Now().Before(entry.expires) {
+		c.remove(element)
+		return nil
+	}
+
+	c.recent.MoveToFront(element)
+
+	return &entry.cacheEntry
+}
+
+func (c *localCache) remove(element *list.Element) {
+	c.recent.Remove(element)
+	delete(c.entries, element.Value.(*localCacheEntry).key)
+}
@@ -0,0 +1,569 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jralph/hackernews-api/internal/scraper"
+	"github.com/jralph/hackernews-api/internal/server"
+)
+
+// Memory keeps everything in process, for tests, demos and single binary
+// deployments that do not need the data to outlive the process. It behaves
+// the same as the redis store, with items stored as json and listed in
+// indexes of the items that are not deleted or dead.
+type Memory struct {
+	mu         sync.RWMutex
+	items      map[int][]byte
+	index      map[int]*scraper.ItemResponse
+	users      map[string][]byte
+	feeds      map[scraper.Feed][]int
+	maxItem    int
+	lastScrape int64
+	generation int64
+	previous   *changeSet
+
+	cache *localCache
+}
+
+func NewMemoryStore(opts ...Option) *Memory {
+	o := newOptions(opts...)
+
+	return &Memory{
+		items: map[int][]byte{},
+		index: map[int]*scraper.ItemResponse{},
+		users: map[string][]byte{},
+		feeds: map[scraper.Feed][]int{},
+		cache: newLocalCache(o),
+	}
+}
+
+// Close does nothing, the data is dropped along with the store.
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) SaveTopStories(ctx context.Context, topStories scraper.TopStoriesResponse) error {
+	return m.SaveFeed(ctx, scraper.FeedTop, topStories)
+}
+
+func (m *Memory) SaveFeed(ctx context.Context, feed scraper.Feed, items []int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.setFeed(feed, items)
+
+	return nil
+}
+
+func (m *Memory) GetTopStories(ctx context.Context, query server.ListQuery) (server.ListResult, error) {
+	return m.GetFeed(ctx, scraper.FeedTop, query)
+}
+
+func (m *Memory) GetFeed(ctx context.Context, feed scraper.Feed, query server.ListQuery) (server.ListResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ids := m.feeds[feed]
+
+	return server.ListResult{IDs: page(ids, query), Total: len(ids)}, nil
+}
+
+func (m *Memory) SaveItem(ctx context.Context, item *scraper.ItemResponse) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := parseItem(string(data))
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.setItem(item.ID, data, parsed)
+
+	return nil
+}
+
+func (m *Memory) DeleteItem(ctx context.Context, item *scraper.ItemResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, tombstone, err := m.tombstone(item)
+	if err != nil {
+		return err
+	}
+
+	m.setItem(item.ID, data, tombstone)
+
+	return nil
+}
+
+func (m *Memory) SaveUser(ctx context.Context, user *scraper.UserResponse) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.users[user.ID] = data
+
+	return nil
+}
+
+func (m *Memory) GetUser(ctx context.Context, id string) (*scraper.UserResponse, error) {
+	m.mu.RLock()
+	data, ok := m.users[id]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+
+	var user scraper.UserResponse
+
+	err := json.Unmarshal(data, &user)
+
+	return &user, err
+}
+
+func (m *Memory) SaveMaxItem(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.maxItem = id
+
+	return nil
+}
+
+func (m *Memory) LastMaxItem(ctx context.Context) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.maxItem, nil
+}
+
+func (m *Memory) SaveLastScrape(ctx context.Context, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastScrape = at.Unix()
+	m.generation++
+
+	return nil
+}
+
+func (m *Memory) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *Memory) Status(ctx context.Context) (server.StoreStatus, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	status := server.StoreStatus{Items: len(m.index), Types: map[string]int{}}
+	if m.lastScrape != 0 {
+		status.LastScrape = time.Unix(m.lastScrape, 0)
+	}
+
+	for _, itemType := range itemTypes {
+		status.Types[itemType] = 0
+	}
+	for _, item := range m.index {
+		if _, ok := status.Types[item.Type]; ok {
+			status.Types[item.Type]++
+		}
+	}
+
+	return status, nil
+}
+
+func (m *Memory) GetAllItems(ctx context.Context, query server.ListQuery) (server.ListResult, error) {
+	return m.query(func(item *scraper.ItemResponse) bool {
+		return true
+	}, query), nil
+}
+
+func (m *Memory) GetAllPosts(ctx context.Context, postType *string, query server.ListQuery) (server.ListResult, error) {
+	return m.query(func(item *scraper.ItemResponse) bool {
+		if postType != nil {
+			return item.Type == *postType
+		}
+
+		return postTypes[item.Type]
+	}, query), nil
+}
+
+func (m *Memory) GetItem(ctx context.Context, id int) (*scraper.ItemResponse, error) {
+	items, err := m.GetItems(ctx, []int{id})
+	if err != nil {
+		return nil, err
+	}
+
+	return items[0], nil
+}
+
+func (m *Memory) GetItems(ctx context.Context, ids []int) ([]*scraper.ItemResponse, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	items := make([]*scraper.ItemResponse, len(ids))
+	for i, id := range ids {
+		data, ok := m.items[id]
+		if !ok {
+			continue
+		}
+
+		var scrapedItem scraper.ItemResponse
+		err := json.Unmarshal(data, &scrapedItem)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = &scrapedItem
+	}
+
+	return items, nil
+}
+
+// query lists the indexed items that are listed and match the filters of
+// query, in the requested order. Items with the same value for the sort field
+// are ordered the same way as in redis, by the text of their id.
+func (m *Memory) query(listed func(*scraper.ItemResponse) bool, query server.ListQuery) server.ListResult {
+	type member struct {
+		id    int
+		value int
+	}
+
+	m.mu.RLock()
+	var members []member
+	for _, item := range m.index {
+		if !listed(item) || !matchesQuery(item, query) {
+			continue
+		}
+
+		value := item.ID
+		if query.Sort != server.SortID {
+			var ok bool
+			value, ok = sortValues(item)[query.Sort]
+			if !ok {
+				continue
+			}
+		}
+
+		members = append(members, member{id: item.ID, value: value})
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].value != members[j].value {
+			return members[i].value < members[j].value
+		}
+
+		return strconv.Itoa(members[i].id) < strconv.Itoa(members[j].id)
+	})
+
+	ids := make([]int, 0, len(members))
+	for _, member := range members {
+		ids = append(ids, member.id)
+	}
+	if query.Desc {
+		for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+			ids[i], ids[j] = ids[j], ids[i]
+		}
+	}
+
+	return server.ListResult{IDs: page(ids, query), Total: len(ids)}
+}
+
+func matchesQuery(item *scraper.ItemResponse, query server.ListQuery) bool {
+	switch {
+	case query.Type != "" && item.Type != query.Type:
+		return false
+	case query.By != "" && item.By != query.By:
+		return false
+	case query.MinScore != nil && item.Score < *query.MinScore:
+		return false
+	case query.Since != 0 && item.Time < query.Since:
+		return false
+	case query.Until != 0 && item.Time > query.Until:
+		return false
+	}
+
+	return true
+}
+
+// page returns a copy of the ids selected by the offset and limit of query.
+func page(ids []int, query server.ListQuery) []int {
+	start := query.Offset
+	if start > len(ids) {
+		start = len(ids)
+	}
+
+	end := len(ids)
+	if query.Limit > 0 && start+query.Limit < end {
+		end = start + query.Limit
+	}
+
+	return append([]int{}, ids[start:end]...)
+}
+
+// setItem stores data as the item with the given id, indexing parsed unless
+// it is a tombstone, or removes the item if data is nil. The write lock must
+// be held.
+func (m *Memory) setItem(id int, data []byte, parsed *scraper.ItemResponse) {
+	if data == nil {
+		delete(m.items, id)
+		delete(m.index, id)
+		return
+	}
+
+	m.items[id] = data
+	if parsed.Deleted || parsed.Dead {
+		delete(m.index, id)
+		return
+	}
+	m.index[id] = parsed
+}
+
+// setFeed stores a copy of ids as the feed, or removes the feed if there are
+// none. The write lock must be held.
+func (m *Memory) setFeed(feed scraper.Feed, ids []int) {
+	if len(ids) == 0 {
+		delete(m.feeds, feed)
+		return
+	}
+
+	m.feeds[feed] = append([]int{}, ids...)
+}
+
+// tombstone builds the tombstone replacing item, keeping the parent of the
+// stored item. The lock must be held.
+func (m *Memory) tombstone(item *scraper.ItemResponse) ([]byte, *scraper.ItemResponse, error) {
+	stored, err := parseItem(string(m.items[item.ID]))
+	if err != nil {
+		return nil, nil, err
+	}
+	if stored == nil {
+		stored = item
+	}
+
+	tombstone := newTombstone(item, stored)
+	data, err := json.Marshal(tombstone)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, tombstone, nil
+}
+
+func (m *Memory) Cache(ctx context.Context, key string, duration time.Duration, target interface{}, f func(context.Context) (interface{}, error)) error {
+	m.mu.RLock()
+	generation := m.generation
+	m.mu.RUnlock()
+
+	return m.cache.get(ctx, key, generation, duration, target, f)
+}
+
+// memorySnapshot stages writes until it is committed.
+type memorySnapshot struct {
+	m       *Memory
+	mu      sync.Mutex
+	changes *changeSet
+}
+
+func (m *Memory) Snapshot(ctx context.Context) (scraper.Snapshot, error) {
+	return &memorySnapshot{m: m, changes: newChangeSet()}, nil
+}
+
+func (s *memorySnapshot) SaveFeed(ctx context.Context, feed scraper.Feed, items []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.changes.feeds[feed] = append([]int{}, items...)
+
+	return nil
+}
+
+func (s *memorySnapshot) SaveItem(ctx context.Context, item *scraper.ItemResponse) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	return s.stageItem(item.ID, data)
+}
+
+func (s *memorySnapshot) DeleteItem(ctx context.Context, item *scraper.ItemResponse) error {
+	data, err := json.Marshal(newTombstone(item, item))
+	if err != nil {
+		return err
+	}
+
+	return s.stageItem(item.ID, data)
+}
+
+func (s *memorySnapshot) SaveUser(ctx context.Context, user *scraper.UserResponse) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.changes.users[user.ID] = data
+
+	return nil
+}
+
+func (s *memorySnapshot) LastMaxItem(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	maxItem := s.changes.maxItem
+	s.mu.Unlock()
+
+	if maxItem == nil {
+		return s.m.LastMaxItem(ctx)
+	}
+
+	return *maxItem, nil
+}
+
+func (s *memorySnapshot) SaveMaxItem(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.changes.maxItem = &id
+
+	return nil
+}
+
+func (s *memorySnapshot) SaveLastScrape(ctx context.Context, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unix := at.Unix()
+	s.changes.lastScrape = &unix
+
+	return nil
+}
+
+// Commit publishes every staged write at once.
+func (s *memorySnapshot) Commit(ctx context.Context) error {
+	changes := s.take()
+
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if changes.empty() {
+		// Keep the previous snapshot rather than replacing it with nothing.
+		return nil
+	}
+
+	return s.m.promote(changes)
+}
+
+func (s *memorySnapshot) Discard(ctx context.Context) error {
+	s.take()
+	return nil
+}
+
+func (s *memorySnapshot) stageItem(id int, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.changes.items[id] = data
+
+	return nil
+}
+
+// take returns the staged changes, leaving the snapshot empty.
+func (s *memorySnapshot) take() *changeSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes := s.changes
+	s.changes = newChangeSet()
+
+	return changes
+}
+
+func (m *Memory) Rollback(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.previous == nil || m.previous.empty() {
+		return errNoPreviousSnapshot
+	}
+
+	return m.promote(m.previous)
+}
+
+// promote applies changes to the live data, saving the values they replace as
+// the previous snapshot. Items are parsed before anything is changed, so a
+// failure leaves the live data untouched. The write lock must be held.
+func (m *Memory) promote(changes *changeSet) error {
+	items := map[int]*scraper.ItemResponse{}
+	data := map[int][]byte{}
+	for id, staged := range changes.items {
+		item, err := parseItem(string(staged))
+		if err != nil {
+			return err
+		}
+
+		// Tombstones keep the parent of the item they replace.
+		if item != nil && (item.Deleted || item.Dead) {
+			staged, item, err = m.tombstone(item)
+			if err != nil {
+				return err
+			}
+		}
+
+		items[id], data[id] = item, staged
+	}
+
+	previous := newChangeSet()
+
+	for id := range changes.items {
+		previous.items[id] = m.items[id]
+		m.setItem(id, data[id], items[id])
+	}
+
+	for id, user := range changes.users {
+		previous.users[id] = m.users[id]
+		if user == nil {
+			delete(m.users, id)
+			continue
+		}
+		m.users[id] = user
+	}
+
+	for feed, ids := range changes.feeds {
+		previous.feeds[feed] = m.feeds[feed]
+		m.setFeed(feed, ids)
+	}
+
+	if changes.maxItem != nil {
+		maxItem := m.maxItem
+		previous.maxItem = &maxItem
+		m.maxItem = *changes.maxItem
+	}
+
+	if changes.lastScrape != nil {
+		lastScrape := m.lastScrape
+		previous.lastScrape = &lastScrape
+		m.lastScrape = *changes.lastScrape
+	}
+
+	m.previous = previous
+	m.generation++
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jralph/hackernews-api/internal/scraper"
+	"github.com/jralph/hackernews-api/internal/server"
+	"github.com/jralph/hackernews-api/pkg/storage/storagetest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+
+	t.Run("NewMemoryStore returns instance of Memory and implements scraper saver interface", func(t *testing.T) {
+		_, okSaver := interface{}(store).(scraper.Saver)
+		_, okStorage := interface{}(store).(server.Storage)
+		require.IsType(t, &Memory{}, store)
+		require.True(t, okSaver)
+		require.True(t, okStorage)
+	})
+}
+
+func TestMemoryConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Store {
+		return NewMemoryStore()
+	})
+}
+
+func TestMemoryCacheStaleWhileRevalidate(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(WithStaleWhileRevalidate(time.Minute))
+
+	var calls int32
+	generate := func(ctx context.Context) (interface{}, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	}
+
+	var value int
+	require.NoError(t, store.Cache(ctx, "stale", time.Millisecond*50, &value, generate))
+	assert.Equal(t, 1, value)
+
+	time.Sleep(time.Millisecond * 60)
+
+	t.Run("Cache serves stale values while refreshing them", func(t *testing.T) {
+		require.NoError(t, store.Cache(ctx, "stale", time.Millisecond*50, &value, generate))
+		assert.Equal(t, 1, value)
+		assert.Equal(t, float64(1), testutil.ToFloat64(store.cache.metrics.cache.WithLabelValues("stale")))
+
+		assert.Eventually(t, func() bool {
+			var refreshed int
+			require.NoError(t, store.Cache(ctx, "stale", time.Minute, &refreshed, generate))
+			return refreshed == 2
+		}, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("Cache does not serve stale values once a scrape finishes", func(t *testing.T) {
+		require.NoError(t, store.Cache(ctx, "scraped", time.Millisecond*50, &value, generate))
+		before := atomic.LoadInt32(&calls)
+
+		time.Sleep(time.Millisecond * 60)
+		require.NoError(t, store.SaveLastScrape(ctx, time.Now()))
+
+		require.NoError(t, store.Cache(ctx, "scraped", time.Millisecond*50, &value, generate))
+		assert.Equal(t, int(before+1), value)
+	})
+}
+
+func TestMemoryCacheCancel(t *testing.T) {
+	store := NewMemoryStore()
+
+	t.Run("Cache cancels generation once the waiting request has gone", func(t *testing.T) {
+		cancelled := make(chan struct{})
+		generate := func(ctx context.Context) (interface{}, error) {
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+		defer cancel()
+
+		var value string
+		err := store.Cache(ctx, "abandoned", time.Minute, &value, generate)
+
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("generation was not cancelled")
+		}
+	})
+}
+
+func TestMemoryCacheSize(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(WithCacheSize(2))
+
+	calls := map[string]int{}
+	cache := func(key string) {
+		var value int
+		require.NoError(t, store.Cache(ctx, key, time.Minute, &value, func(ctx context.Context) (interface{}, error) {
+			calls[key]++
+			return calls[key], nil
+		}))
+	}
+
+	cache("a")
+	cache("b")
+	cache("a")
+	cache("c")
+
+	t.Run("Cache drops the least recently used value once full", func(t *testing.T) {
+		cache("a")
+		cache("c")
+		assert.Equal(t, map[string]int{"a": 1, "b": 1, "c": 1}, calls)
+
+		cache("b")
+		assert.Equal(t, 2, calls["b"])
+		assert.Len(t, store.cache.entries, 2)
+	})
+}
@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metrics struct {
+	cache *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		cache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hn_cache_requests_total",
+			Help: "Cached responses requested from the store, by whether they were a hit or a miss.",
+		}, []string{"result"}),
+	}
+}
+
+// WithMetrics registers the cache hit and miss counters with registerer.
+func WithMetrics(registerer prometheus.Registerer) Option {
+	return func(o *options) {
+		registerer.MustRegister(o.metrics.cache)
+	}
+}
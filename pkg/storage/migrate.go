@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jralph/hackernews-api/internal/scraper"
+)
+
+const schemaVersionKey = keyPrefix + "schema_version"
+
+var (
+	legacyItemKey  = regexp.MustCompile(`^hn_item_(story|job|poll|comment|pollopt)_([0-9]+)$`)
+	currentItemKey = regexp.MustCompile(`^hn_item_([0-9]+)$`)
+)
+
+// migrations upgrade the stored data one schema version at a time, the
+// schema version being the number of migrations applied.
+var migrations = []func(context.Context, *Redis) (int, error){
+	migrateLegacyItemKeys,
+	reindexItems,
+	migrateFeedsToLists,
+	migrateToHashTaggedIndexes,
+	dropChunkedSnapshots,
+}
+
+// Migrate upgrades data saved by older versions to the current key schema
+// and indexes. It is safe to run repeatedly, and returns the number of items
+// rewritten. Older versions only wrote to the unnamed keyspace, so that is the
+// one migrated.
+func (r *Redis) Migrate(ctx context.Context) (int, error) {
+	version, err := r.client.Get(ctx, schemaVersionKey).Int()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for ; version < len(migrations); version++ {
+		count, err := migrations[version](ctx, r.pin(keyspace{}))
+		migrated += count
+		if err != nil {
+			return migrated, err
+		}
+
+		err = r.client.Set(ctx, schemaVersionKey, version+1, 0).Err()
+		if err != nil {
+			return migrated, err
+		}
+	}
+
+	return migrated, nil
+}
+
+// migrateLegacyItemKeys moves items saved under hn_item_<type>_<id> keys to
+// id only keys.
+func migrateLegacyItemKeys(ctx context.Context, r *Redis) (int, error) {
+	return r.scanItems(ctx, "hn_item_*_*", legacyItemKey, func(key string, item *scraper.ItemResponse) error {
+		err := r.SaveItem(ctx, item)
+		if err != nil {
+			return err
+		}
+
+		return r.client.Del(ctx, key).Err()
+	})
+}
+
+// reindexItems resaves every item to populate the author and sort indexes.
+func reindexItems(ctx context.Context, r *Redis) (int, error) {
+	return r.scanItems(ctx, "hn_item_*", currentItemKey, func(key string, item *scraper.ItemResponse) error {
+		return r.SaveItem(ctx, item)
+	})
+}
+
+// migrateFeedsToLists converts feeds saved as json arrays to lists.
+func migrateFeedsToLists(ctx context.Context, r *Redis) (int, error) {
+	for _, feed := range scraper.Feeds {
+		data, err := r.client.Get(ctx, keyspace{}.feed(feed)).Result()
+		if err == redis.Nil || isWrongType(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		var items []int
+		err = json.Unmarshal([]byte(data), &items)
+		if err != nil {
+			return 0, err
+		}
+
+		err = r.SaveFeed(ctx, feed, items)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return 0, nil
+}
+
+// migrateToHashTaggedIndexes rebuilds the indexes under keys sharing the
+// {hn_index} hash tag by resaving every item, then drops the old indexes and
+// the sorted sets built from them for queries. Staged and previous snapshots
+// are dropped rather than moved.
+func migrateToHashTaggedIndexes(ctx context.Context, r *Redis) (int, error) {
+	migrated, err := r.scanItems(ctx, "hn_item_*", currentItemKey, func(key string, item *scraper.ItemResponse) error {
+		return r.SaveItem(ctx, item)
+	})
+	if err != nil {
+		return migrated, err
+	}
+
+	for _, pattern := range []string{"hn_index_*", "hn_query_*", "hn_snapshot_*"} {
+		err = r.scanKeys(ctx, pattern, func(key string) error {
+			return r.client.Del(ctx, key).Err()
+		})
+		if err != nil {
+			return migrated, err
+		}
+	}
+
+	return migrated, nil
+}
+
+// dropChunkedSnapshots drops the staged and previous snapshots of versions
+// that promoted snapshots by copying their writes over the live data, which
+// cannot be rolled back to now that snapshots are committed by switching
+// keyspaces.
+func dropChunkedSnapshots(ctx context.Context, r *Redis) (int, error) {
+	err := r.scanKeys(ctx, "{hn_snapshot_*", func(key string) error {
+		return r.client.Del(ctx, key).Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return 0, r.client.Del(ctx, keyPrefix+"previous_snapshot").Err()
+}
+
+func isWrongType(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE")
+}
+
+// scanItems calls f for every stored item with a key matching pattern and
+// matcher.
+func (r *Redis) scanItems(ctx context.Context, pattern string, matcher *regexp.Regexp, f func(string, *scraper.ItemResponse) error) (int, error) {
+	count := 0
+
+	err := r.scanKeys(ctx, pattern, func(key string) error {
+		if !matcher.MatchString(key) {
+			return nil
+		}
+
+		data, err := r.client.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var item scraper.ItemResponse
+		err = json.Unmarshal([]byte(data), &item)
+		if err != nil {
+			return err
+		}
+
+		err = f(key, &item)
+		if err != nil {
+			return err
+		}
+
+		count++
+
+		return nil
+	})
+
+	return count, err
+}
+
+// scanKeys calls f for every key matching pattern, without blocking redis the
+// way KEYS would. On a redis cluster the keys of every master are scanned.
+func (r *Redis) scanKeys(ctx context.Context, pattern string, f func(string) error) error {
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		var mu sync.Mutex
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+			return scanNode(ctx, master, pattern, func(key string) error {
+				mu.Lock()
+				defer mu.Unlock()
+
+				return f(key)
+			})
+		})
+	}
+
+	return scanNode(ctx, r.client, pattern, f)
+}
+
+func scanNode(ctx context.Context, client redis.Cmdable, pattern string, f func(string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, pattern, 1000).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			err = f(key)
+			if err != nil {
+				return err
+			}
+		}
+
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jralph/hackernews-api/internal/server"
+)
+
+// queryTTL is how long the intermediate sorted sets built for a query are
+// kept around after they were last used.
+const queryTTL = time.Minute
+
+type scoreRange struct {
+	field string
+	min   string
+	max   string
+}
+
+// query lists the members of the index at baseKey matching the filters of
+// query, in the requested order. Filters are applied by intersecting the
+// base index with the type and author indexes, and with copies of the score
+// and time indexes trimmed to the requested range, so the work happens inside
+// redis rather than by fetching every item. The result is reused by the same
+// query until the data is next written.
+func (r *Redis) query(ctx context.Context, keys keyspace, baseKey string, query server.ListQuery) (server.ListResult, error) {
+	sortKey := baseKey
+	if query.Sort != server.SortID {
+		sortKey = keys.sortIndex(query.Sort)
+	}
+
+	var filters []string
+	if sortKey != baseKey {
+		filters = append(filters, baseKey)
+	}
+	if query.Type != "" && keys.typeIndex(query.Type) != baseKey {
+		filters = append(filters, keys.typeIndex(query.Type))
+	}
+	if query.By != "" {
+		filters = append(filters, keys.authorIndex(query.By))
+	}
+
+	lower, upper := "-inf", "+inf"
+	var ranges []scoreRange
+	if query.MinScore != nil {
+		ranges = append(ranges, scoreRange{field: server.SortScore, min: strconv.Itoa(*query.MinScore), max: "+inf"})
+	}
+	if query.Since != 0 || query.Until != 0 {
+		timeRange := scoreRange{field: server.SortTime, min: "-inf", max: "+inf"}
+		if query.Since != 0 {
+			timeRange.min = strconv.Itoa(query.Since)
+		}
+		if query.Until != 0 {
+			timeRange.max = strconv.Itoa(query.Until)
+		}
+		ranges = append(ranges, timeRange)
+	}
+
+	var rangeFilters []scoreRange
+	for _, scoreRange := range ranges {
+		if scoreRange.field == query.Sort {
+			lower, upper = scoreRange.min, scoreRange.max
+			continue
+		}
+		rangeFilters = append(rangeFilters, scoreRange)
+	}
+
+	key := sortKey
+	filtered := len(filters) > 0 || len(rangeFilters) > 0
+	if filtered {
+		writes, err := countWrites(ctx, r.client, keys)
+		if err != nil {
+			return server.ListResult{IDs: []int{}}, err
+		}
+		key = queryKey(keys, baseKey, query, writes)
+
+		// Reuse the sorted set built for the same query since the last write,
+		// keeping it for another queryTTL.
+		var exists *redis.BoolCmd
+		var count *redis.IntCmd
+		var members *redis.StringSliceCmd
+		_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			exists = pipe.Expire(ctx, key, queryTTL)
+			count, members = readRange(ctx, pipe, key, lower, upper, query)
+			return nil
+		})
+		if err != nil {
+			return server.ListResult{IDs: []int{}}, err
+		}
+		if exists.Val() {
+			return listResult(count, members)
+		}
+	}
+
+	var count *redis.IntCmd
+	var members *redis.StringSliceCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if filtered {
+			var rangeKeys []string
+			for _, rangeFilter := range rangeFilters {
+				rangeKey := fmt.Sprintf("%s_%s", key, rangeFilter.field)
+				pipe.ZInterStore(ctx, rangeKey, &redis.ZStore{
+					Keys:    append([]string{keys.sortIndex(rangeFilter.field)}, filters...),
+					Weights: intersectWeights(len(filters)),
+				})
+				pipe.ZRemRangeByScore(ctx, rangeKey, "-inf", fmt.Sprintf("(%s", rangeFilter.min))
+				pipe.ZRemRangeByScore(ctx, rangeKey, fmt.Sprintf("(%s", rangeFilter.max), "+inf")
+				pipe.Expire(ctx, rangeKey, queryTTL)
+				rangeKeys = append(rangeKeys, rangeKey)
+			}
+
+			// Each range key has already been intersected with the filters.
+			if len(rangeKeys) > 0 {
+				filters = rangeKeys
+			}
+
+			pipe.ZInterStore(ctx, key, &redis.ZStore{
+				Keys:    append([]string{sortKey}, filters...),
+				Weights: intersectWeights(len(filters)),
+			})
+			pipe.Expire(ctx, key, queryTTL)
+		}
+
+		count, members = readRange(ctx, pipe, key, lower, upper, query)
+
+		return nil
+	})
+	if err != nil {
+		return server.ListResult{IDs: []int{}}, err
+	}
+
+	return listResult(count, members)
+}
+
+// readRange queues reading the page of the sorted set at key within lower
+// and upper that query asks for, along with how many members are in range.
+func readRange(ctx context.Context, pipe redis.Pipeliner, key string, lower string, upper string, query server.ListQuery) (*redis.IntCmd, *redis.StringSliceCmd) {
+	count := pipe.ZCount(ctx, key, lower, upper)
+
+	rangeBy := &redis.ZRangeBy{Min: lower, Max: upper, Offset: int64(query.Offset), Count: int64(query.Limit)}
+	if query.Limit <= 0 {
+		rangeBy.Count = -1
+	}
+	if query.Desc {
+		return count, pipe.ZRevRangeByScore(ctx, key, rangeBy)
+	}
+
+	return count, pipe.ZRangeByScore(ctx, key, rangeBy)
+}
+
+func listResult(count *redis.IntCmd, members *redis.StringSliceCmd) (server.ListResult, error) {
+	ids, err := parseIDs(members.Val())
+	if err != nil {
+		return server.ListResult{IDs: []int{}}, err
+	}
+
+	return server.ListResult{IDs: ids, Total: int(count.Val())}, nil
+}
+
+// intersectWeights keeps the score of the first key of an intersection, which
+// is the index being sorted by, and ignores the scores of the filters.
+func intersectWeights(filters int) []float64 {
+	weights := []float64{1}
+	for i := 0; i < filters; i++ {
+		weights = append(weights, 0)
+	}
+
+	return weights
+}
+
+// queryKey is the key the sorted set built for query is kept under. It
+// changes with every write to the keyspace, so sets built from older data are
+// never reused.
+func queryKey(keys keyspace, baseKey string, query server.ListQuery, writes int64) string {
+	minScore := ""
+	if query.MinScore != nil {
+		minScore = strconv.Itoa(*query.MinScore)
+	}
+
+	hash := sha1.Sum([]byte(fmt.Sprintf("%s|%s|%s|%s|%s|%d|%d|%d", baseKey, query.Sort, query.Type, query.By, minScore, query.Since, query.Until, writes)))
+
+	return fmt.Sprintf("%squery_%x", keys.indexPrefix(), hash)
+}
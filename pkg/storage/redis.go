@@ -3,137 +3,357 @@ package storage
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"regexp"
 	"strconv"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/jralph/hackernews-api/internal/scraper"
+	"github.com/jralph/hackernews-api/internal/server"
 )
 
-var ctx = context.Background()
+// generationKey holds a counter incremented whenever a scrape finishes or a
+// snapshot is committed or rolled back, so cached responses built from older
+// data can be detected.
+const generationKey = keyPrefix + "generation"
 
 type Redis struct {
-	client *redis.Client
+	client   redis.UniversalClient
+	metrics  *metrics
+	staleFor time.Duration
+	flights  flightGroup
+
+	// pinned is the keyspace every read and write goes to, or nil to use the
+	// live keyspace. Snapshots pin the keyspace their writes are staged in.
+	pinned *keyspace
 }
 
-type Option func(*Redis)
-
+// WithRedisOptions connects the redis store to the server described by opts.
 func WithRedisOptions(opts *redis.Options) Option {
-	return func(r *Redis) {
-		r.client = redis.NewClient(opts)
+	return func(o *options) {
+		o.client = redis.NewClient(opts)
 	}
 }
 
-func WithRedis(client *redis.Client) Option {
-	return func(r *Redis) {
-		r.client = client
+// WithRedis uses client for the redis store. Any universal client works: a
+// single server, a sentinel failover client or a cluster client.
+func WithRedis(client redis.UniversalClient) Option {
+	return func(o *options) {
+		o.client = client
 	}
 }
 
 func NewRedisStore(opts ...Option) *Redis {
-	client := &Redis{
-		client: redis.NewClient(&redis.Options{
+	o := newOptions(opts...)
+	if o.client == nil {
+		o.client = redis.NewClient(&redis.Options{
 			Addr: "127.0.0.1",
-		}),
+		})
 	}
 
-	for _, opt := range opts {
-		opt(client)
+	return &Redis{
+		client:   o.client,
+		metrics:  o.metrics,
+		staleFor: o.staleFor,
 	}
+}
+
+// Close closes the connections to redis.
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
 
-	return client
+func (r *Redis) SaveTopStories(ctx context.Context, topStories scraper.TopStoriesResponse) error {
+	return r.SaveFeed(ctx, scraper.FeedTop, topStories)
 }
 
-func (r *Redis) SaveTopStories(topStories scraper.TopStoriesResponse) error {
-	data, err := json.Marshal(topStories)
+// SaveFeed stores the feed as a redis list.
+func (r *Redis) SaveFeed(ctx context.Context, feed scraper.Feed, items []int) error {
+	keys, err := r.keys(ctx)
 	if err != nil {
 		return err
 	}
-	return r.client.Set(ctx, "hn_top_stories", data, 0).Err()
+
+	return r.write(ctx, keys, func(pipe redis.Pipeliner) {
+		pipe.Del(ctx, keys.feed(feed))
+		if len(items) > 0 {
+			pipe.RPush(ctx, keys.feed(feed), intMembers(items)...)
+		}
+	})
 }
 
-func (r *Redis) SaveItem(item *scraper.ItemResponse) error {
-	data, err := json.Marshal(item)
+func (r *Redis) GetTopStories(ctx context.Context, query server.ListQuery) (server.ListResult, error) {
+	return r.GetFeed(ctx, scraper.FeedTop, query)
+}
+
+func (r *Redis) GetFeed(ctx context.Context, feed scraper.Feed, query server.ListQuery) (server.ListResult, error) {
+	stop := int64(-1)
+	if query.Limit > 0 {
+		stop = int64(query.Offset + query.Limit - 1)
+	}
+
+	keys, err := r.keys(ctx)
+	if err != nil {
+		return server.ListResult{IDs: []int{}}, err
+	}
+
+	var members *redis.StringSliceCmd
+	var total *redis.IntCmd
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		members = pipe.LRange(ctx, keys.feed(feed), int64(query.Offset), stop)
+		total = pipe.LLen(ctx, keys.feed(feed))
+		return nil
+	})
+	if err != nil {
+		return server.ListResult{IDs: []int{}}, err
+	}
+
+	ids, err := parseIDs(members.Val())
+	if err != nil {
+		return server.ListResult{IDs: []int{}}, err
+	}
+
+	return server.ListResult{IDs: ids, Total: int(total.Val())}, nil
+}
+
+func (r *Redis) SaveItem(ctx context.Context, item *scraper.ItemResponse) error {
+	return r.SaveItems(ctx, []*scraper.ItemResponse{item})
+}
+
+// SaveItems stores and reindexes a batch of items in a single transaction,
+// taking one round trip however many items there are.
+func (r *Redis) SaveItems(ctx context.Context, items []*scraper.ItemResponse) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	data := make([][]byte, len(items))
+	for i, item := range items {
+		var err error
+		data[i], err = json.Marshal(item)
+		if err != nil {
+			return err
+		}
+	}
+
+	keys, err := r.keys(ctx)
 	if err != nil {
 		return err
 	}
-	return r.client.Set(ctx, fmt.Sprintf("hn_item_%s_%d", item.Type, item.ID), data, 0).Err()
+
+	return r.write(ctx, keys, func(pipe redis.Pipeliner) {
+		for i, item := range items {
+			saveItem(ctx, pipe, keys, item, item, data[i])
+		}
+	})
 }
 
-func (r *Redis) DeleteItem(item *scraper.ItemResponse) error {
-	return r.client.Del(ctx, fmt.Sprintf("hn_item_%s_%d", item.Type, item.ID)).Err()
+func (r *Redis) DeleteItem(ctx context.Context, item *scraper.ItemResponse) error {
+	keys, err := r.keys(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Deleted items are returned without their author, so use the stored
+	// item to find which author index to remove it from.
+	stored, err := r.getItem(ctx, keys, item.ID)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		stored = item
+	}
+
+	data, err := json.Marshal(newTombstone(item, stored))
+	if err != nil {
+		return err
+	}
+
+	return r.write(ctx, keys, func(pipe redis.Pipeliner) {
+		deleteItem(ctx, pipe, keys, item.ID, stored, data)
+	})
+}
+
+// saveItem stores item as data and reindexes it, removing it from the indexes
+// stored was listed in.
+func saveItem(ctx context.Context, pipe redis.Pipeliner, keys keyspace, item *scraper.ItemResponse, stored *scraper.ItemResponse, data []byte) {
+	pipe.Set(ctx, keys.item(item.ID), data, 0)
+	removeFromIndexes(ctx, pipe, keys, stored)
+	addToIndexes(ctx, pipe, keys, item)
 }
 
-func (r *Redis) GetAllItems() ([]int, error) {
-	keys, err := r.client.Keys(ctx, "hn_item_*").Result()
+// deleteItem replaces the item with tombstone data and removes it from the
+// indexes stored was listed in.
+func deleteItem(ctx context.Context, pipe redis.Pipeliner, keys keyspace, id int, stored *scraper.ItemResponse, data []byte) {
+	pipe.Set(ctx, keys.item(id), data, 0)
+	pipe.ZRem(ctx, keys.itemsIndex(), id)
+	removeFromIndexes(ctx, pipe, keys, stored)
+}
+
+func newTombstone(item *scraper.ItemResponse, stored *scraper.ItemResponse) *scraper.ItemResponse {
+	return &scraper.ItemResponse{
+		ID:      item.ID,
+		Parent:  stored.Parent,
+		Deleted: item.Deleted || !item.Dead,
+		Dead:    item.Dead,
+	}
+}
+
+func (r *Redis) SaveUser(ctx context.Context, user *scraper.UserResponse) error {
+	data, err := json.Marshal(user)
 	if err != nil {
-		return []int{}, err
+		return err
 	}
 
-	matchesPost := regexp.MustCompile(`hn_item_(story|job|poll|comment|pollopt)_([0-9]+)`)
+	keys, err := r.keys(ctx)
+	if err != nil {
+		return err
+	}
 
-	var items []int
-	for _, key := range keys {
-		if !matchesPost.MatchString(key) {
-			continue
-		}
+	return r.write(ctx, keys, func(pipe redis.Pipeliner) {
+		pipe.Set(ctx, keys.user(user.ID), data, 0)
+	})
+}
 
-		match := matchesPost.FindStringSubmatch(key)
+func (r *Redis) GetUser(ctx context.Context, id string) (*scraper.UserResponse, error) {
+	keys, err := r.keys(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-		foundId, err := strconv.Atoi(match[2])
-		if err != nil {
-			return []int{}, err
-		}
-		items = append(items, foundId)
+	data, err := r.client.Get(ctx, keys.user(id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return items, nil
+	var user scraper.UserResponse
+
+	err = json.Unmarshal([]byte(data), &user)
+
+	return &user, err
 }
 
-func (r *Redis) GetAllPosts(postType *string) ([]int, error) {
-	keys, err := r.client.Keys(ctx, "hn_item_*").Result()
+func (r *Redis) SaveMaxItem(ctx context.Context, id int) error {
+	keys, err := r.keys(ctx)
 	if err != nil {
-		return []int{}, err
+		return err
 	}
 
-	searchTypes := "story|job|poll"
-	if postType != nil {
-		searchTypes = *postType
+	return r.write(ctx, keys, func(pipe redis.Pipeliner) {
+		pipe.Set(ctx, keys.maxItem(), id, 0)
+	})
+}
+
+func (r *Redis) LastMaxItem(ctx context.Context) (int, error) {
+	keys, err := r.keys(ctx)
+	if err != nil {
+		return 0, err
 	}
 
-	matchesPost := regexp.MustCompile(fmt.Sprintf("hn_item_(%s)_([0-9]+)", searchTypes))
+	id, err := r.client.Get(ctx, keys.maxItem()).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
 
-	var items []int
-	for _, key := range keys {
-		if !matchesPost.MatchString(key) {
-			continue
+	return id, err
+}
+
+// SaveLastScrape bumps the data generation, unless the store is pinned to the
+// keyspace of a snapshot, which bumps it when it is committed.
+func (r *Redis) SaveLastScrape(ctx context.Context, at time.Time) error {
+	keys, err := r.keys(ctx)
+	if err != nil {
+		return err
+	}
+
+	return r.write(ctx, keys, func(pipe redis.Pipeliner) {
+		pipe.Set(ctx, keys.lastScrape(), at.Unix(), 0)
+		if r.pinned == nil {
+			pipe.Incr(ctx, generationKey)
 		}
+	})
+}
 
-		match := matchesPost.FindStringSubmatch(key)
+func (r *Redis) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
 
-		foundId, err := strconv.Atoi(match[2])
-		if err != nil {
-			return []int{}, err
+func (r *Redis) Status(ctx context.Context) (server.StoreStatus, error) {
+	status := server.StoreStatus{Types: map[string]int{}}
+
+	keys, err := r.keys(ctx)
+	if err != nil {
+		return status, err
+	}
+
+	var lastScrape *redis.StringCmd
+	var items *redis.IntCmd
+	types := map[string]*redis.IntCmd{}
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		lastScrape = pipe.Get(ctx, keys.lastScrape())
+		items = pipe.ZCard(ctx, keys.itemsIndex())
+		for _, itemType := range itemTypes {
+			types[itemType] = pipe.ZCard(ctx, keys.typeIndex(itemType))
 		}
-		items = append(items, foundId)
+
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return status, err
 	}
 
-	return items, nil
+	if at, err := lastScrape.Int64(); err == nil {
+		status.LastScrape = time.Unix(at, 0)
+	}
+	status.Items = int(items.Val())
+	for itemType, count := range types {
+		status.Types[itemType] = int(count.Val())
+	}
+
+	return status, nil
+}
+
+func (r *Redis) GetAllItems(ctx context.Context, query server.ListQuery) (server.ListResult, error) {
+	keys, err := r.keys(ctx)
+	if err != nil {
+		return server.ListResult{IDs: []int{}}, err
+	}
+
+	return r.query(ctx, keys, keys.itemsIndex(), query)
 }
 
-func (r *Redis) GetItem(id int) (*scraper.ItemResponse, error) {
-	keys, err := r.client.Keys(ctx, fmt.Sprintf("hn_item_*_%d", id)).Result()
+func (r *Redis) GetAllPosts(ctx context.Context, postType *string, query server.ListQuery) (server.ListResult, error) {
+	keys, err := r.keys(ctx)
+	if err != nil {
+		return server.ListResult{IDs: []int{}}, err
+	}
+
+	if postType != nil {
+		return r.query(ctx, keys, keys.typeIndex(*postType), query)
+	}
+
+	return r.query(ctx, keys, keys.postsIndex(), query)
+}
+
+func (r *Redis) GetItem(ctx context.Context, id int) (*scraper.ItemResponse, error) {
+	keys, err := r.keys(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(keys) == 0 {
+	return r.getItem(ctx, keys, id)
+}
+
+func (r *Redis) getItem(ctx context.Context, keys keyspace, id int) (*scraper.ItemResponse, error) {
+	data, err := r.client.Get(ctx, keys.item(id)).Result()
+	if err == redis.Nil {
 		return nil, nil
 	}
-
-	data, _ := r.client.Get(ctx, keys[0]).Result()
+	if err != nil {
+		return nil, err
+	}
 
 	var scrapedItem scraper.ItemResponse
 
@@ -142,29 +362,131 @@ func (r *Redis) GetItem(id int) (*scraper.ItemResponse, error) {
 	return &scrapedItem, err
 }
 
-func (r *Redis) Cache(key string, duration time.Duration, target interface{}, f func() interface{}) error {
-	// Fetch from cache
-	data, err := r.client.Get(ctx, key).Result()
+// GetItems fetches every item in a single pipeline.
+func (r *Redis) GetItems(ctx context.Context, ids []int) ([]*scraper.ItemResponse, error) {
+	keys, err := r.keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	itemKeys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		itemKeys = append(itemKeys, keys.item(id))
+	}
+
+	values, err := getAll(ctx, r.client, itemKeys)
+	if err != nil {
+		return nil, err
+	}
 
-	// If cache hit unmarshal into target and return
-	if data != "" && err == nil {
-		err = json.Unmarshal([]byte(data), target)
-		if err == nil {
-			return nil
+	items := make([]*scraper.ItemResponse, len(ids))
+	for i, data := range values {
+		if data == "" {
+			continue
 		}
+
+		var scrapedItem scraper.ItemResponse
+		err = json.Unmarshal([]byte(data), &scrapedItem)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = &scrapedItem
 	}
 
-	// If cache hit error, unmarshal error, or no cache hit, generate and cache
-	toCache := f()
+	return items, nil
+}
 
-	encoded, err := json.Marshal(toCache)
-	if err != nil {
-		return err
+// keys returns the keyspace reads and writes go to: the pinned one, or the
+// live one named by currentKeyspaceKey. A redis cluster cannot take
+// snapshots, so always uses the unnamed keyspace.
+func (r *Redis) keys(ctx context.Context) (keyspace, error) {
+	if r.pinned != nil {
+		return *r.pinned, nil
+	}
+	if _, ok := r.client.(*redis.ClusterClient); ok {
+		return keyspace{}, nil
+	}
+
+	return currentKeyspace(ctx, r.client)
+}
+
+// pin returns a view of the store that only reads and writes keys.
+func (r *Redis) pin(keys keyspace) *Redis {
+	return &Redis{
+		client:   r.client,
+		metrics:  r.metrics,
+		staleFor: r.staleFor,
+		pinned:   &keys,
+	}
+}
+
+// write applies f to keys in a single transaction, counting the write.
+func (r *Redis) write(ctx context.Context, keys keyspace, f func(redis.Pipeliner)) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		f(pipe)
+		pipe.Incr(ctx, keys.writes())
+
+		return nil
+	})
+
+	return err
+}
+
+// getAll fetches the values of keys with GET commands sent in a single
+// pipeline. Keys may be in different slots of a redis cluster, so MGET cannot
+// be used. Missing keys have an empty value.
+func getAll(ctx context.Context, client redis.Cmdable, keys []string) ([]string, error) {
+	values := make([]string, 0, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	cmds := make([]*redis.StringCmd, 0, len(keys))
+	_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			cmds = append(cmds, pipe.Get(ctx, key))
+		}
+
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for _, cmd := range cmds {
+		value, err := cmd.Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		values = append(values, value)
 	}
-	err = json.Unmarshal(encoded, target)
+
+	return values, nil
+}
+
+func parseIDs(members []string) ([]int, error) {
+	ids := make([]int, 0, len(members))
+	for _, member := range members {
+		id, err := strconv.Atoi(member)
+		if err != nil {
+			return []int{}, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func parseItem(data string) (*scraper.ItemResponse, error) {
+	if data == "" {
+		return nil, nil
+	}
+
+	var item scraper.ItemResponse
+	err := json.Unmarshal([]byte(data), &item)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return r.client.Set(ctx, key, encoded, duration).Err()
+	return &item, nil
 }
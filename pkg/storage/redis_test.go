@@ -1,16 +1,41 @@
 package storage
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/jralph/hackernews-api/internal/server"
+	"github.com/jralph/hackernews-api/pkg/storage/storagetest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/go-redis/redis/v8"
 
 	"github.com/jralph/hackernews-api/internal/scraper"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+func newTestStore(t *testing.T) (*Redis, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	store := NewRedisStore(
+		WithRedisOptions(&redis.Options{
+			Addr: mr.Addr(),
+		}),
+	)
+
+	return store, mr
+}
+
 func TestNewClient(t *testing.T) {
 	client := NewRedisStore(
 		WithRedisOptions(&redis.Options{}),
@@ -24,3 +49,707 @@ func TestNewClient(t *testing.T) {
 		require.True(t, okStorage)
 	})
 }
+
+func TestRedisConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Store {
+		store, _ := newTestStore(t)
+		return store
+	})
+}
+
+func TestKeyHashTags(t *testing.T) {
+	ctx := context.Background()
+	store, mr := newTestStore(t)
+
+	require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 1, Type: "story", By: "bob", Score: 3}))
+	require.NoError(t, store.SaveUser(ctx, &scraper.UserResponse{ID: "bob"}))
+	require.NoError(t, store.SaveFeed(ctx, scraper.FeedTop, []int{1}))
+
+	_, err := store.GetAllPosts(ctx, nil, server.ListQuery{By: "bob", Sort: server.SortScore, MinScore: intPointer(1)})
+	require.NoError(t, err)
+
+	t.Run("Items, users and feeds are not hash tagged", func(t *testing.T) {
+		for _, key := range []string{"hn_item_1", "hn_user_bob", "hn_top_stories"} {
+			assert.True(t, mr.Exists(key), key)
+		}
+	})
+
+	t.Run("Indexes and queries share a hash tag", func(t *testing.T) {
+		for _, key := range mr.Keys() {
+			if strings.Contains(key, "index") || strings.Contains(key, "query") {
+				assert.True(t, strings.HasPrefix(key, "{hn_index}_"), key)
+			}
+		}
+	})
+}
+
+func TestItems(t *testing.T) {
+	ctx := context.Background()
+	store, mr := newTestStore(t)
+
+	require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 1, Type: "story"}))
+	require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 2, Type: "comment", Parent: 1}))
+	require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 3, Type: "job"}))
+
+	t.Run("Items are stored under id only keys", func(t *testing.T) {
+		assert.True(t, mr.Exists("hn_item_1"))
+		assert.ElementsMatch(t, []string{"1", "2", "3"}, mustZMembers(t, mr, "{hn_index}_items"))
+	})
+
+	t.Run("Items can be fetched by id", func(t *testing.T) {
+		item, err := store.GetItem(ctx, 2)
+		require.NoError(t, err)
+		assert.Equal(t, &scraper.ItemResponse{ID: 2, Type: "comment", Parent: 1}, item)
+
+		item, err = store.GetItem(ctx, 999)
+		require.NoError(t, err)
+		assert.Nil(t, item)
+	})
+
+	t.Run("Items can be fetched in bulk", func(t *testing.T) {
+		items, err := store.GetItems(ctx, []int{3, 999, 1})
+		require.NoError(t, err)
+		assert.Equal(t, []*scraper.ItemResponse{
+			{ID: 3, Type: "job"},
+			nil,
+			{ID: 1, Type: "story"},
+		}, items)
+
+		items, err = store.GetItems(ctx, []int{})
+		require.NoError(t, err)
+		assert.Empty(t, items)
+
+		ids := make([]int, 250)
+		for i := range ids {
+			ids[i] = i%4 + 1
+		}
+		items, err = store.GetItems(ctx, ids)
+		require.NoError(t, err)
+		require.Len(t, items, 250)
+		for i, item := range items {
+			if ids[i] == 4 {
+				assert.Nil(t, item)
+				continue
+			}
+			require.NotNil(t, item)
+			assert.Equal(t, ids[i], item.ID)
+		}
+	})
+
+	t.Run("Items and posts are listed from indexes", func(t *testing.T) {
+		items, err := store.GetAllItems(ctx, server.ListQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{1, 2, 3}, Total: 3}, items)
+
+		posts, err := store.GetAllPosts(ctx, nil, server.ListQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{1, 3}, Total: 2}, posts)
+
+		jobType := "job"
+		jobs, err := store.GetAllPosts(ctx, &jobType, server.ListQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{3}, Total: 1}, jobs)
+	})
+
+	t.Run("Items are paginated with range queries", func(t *testing.T) {
+		items, err := store.GetAllItems(ctx, server.ListQuery{Offset: 1, Limit: 1})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{2}, Total: 3}, items)
+
+		items, err = store.GetAllItems(ctx, server.ListQuery{Offset: 5, Limit: 1})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{}, Total: 3}, items)
+	})
+
+	t.Run("Deleted items are removed from indexes", func(t *testing.T) {
+		require.NoError(t, store.DeleteItem(ctx, &scraper.ItemResponse{ID: 3, Type: "job"}))
+
+		posts, err := store.GetAllPosts(ctx, nil, server.ListQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, []int{1}, posts.IDs)
+		assert.NotContains(t, mustZMembers(t, mr, "{hn_index}_items"), "3")
+	})
+
+	t.Run("Deleted and dead items are replaced with tombstones", func(t *testing.T) {
+		require.NoError(t, store.DeleteItem(ctx, &scraper.ItemResponse{ID: 2, Dead: true}))
+
+		item, err := store.GetItem(ctx, 3)
+		require.NoError(t, err)
+		assert.Equal(t, &scraper.ItemResponse{ID: 3, Deleted: true}, item)
+
+		item, err = store.GetItem(ctx, 2)
+		require.NoError(t, err)
+		assert.Equal(t, &scraper.ItemResponse{ID: 2, Parent: 1, Dead: true}, item)
+
+		_, err = reindexItems(ctx, store)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1"}, mustZMembers(t, mr, "{hn_index}_items"))
+	})
+}
+
+func TestSaveItems(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newTestStore(t)
+
+	items := []*scraper.ItemResponse{
+		{ID: 1, Type: "story", By: "alice", Score: 3},
+		{ID: 2, Type: "comment", By: "bob", Parent: 1},
+		{ID: 3, Type: "job", By: "alice", Score: 1},
+	}
+
+	t.Run("Batches of items are saved and indexed in one transaction", func(t *testing.T) {
+		require.NoError(t, store.SaveItems(ctx, items))
+		require.NoError(t, store.SaveItems(ctx, nil))
+
+		saved, err := store.GetItems(ctx, []int{1, 2, 3})
+		require.NoError(t, err)
+		assert.Equal(t, items, saved)
+
+		posts, err := store.GetAllPosts(ctx, nil, server.ListQuery{By: "alice", Sort: server.SortScore})
+		require.NoError(t, err)
+		assert.Equal(t, []int{3, 1}, posts.IDs)
+	})
+
+	t.Run("Batches of items are staged in snapshots", func(t *testing.T) {
+		snapshot, err := store.Snapshot(ctx)
+		require.NoError(t, err)
+
+		require.NoError(t, snapshot.(scraper.ItemsSaver).SaveItems(ctx, []*scraper.ItemResponse{
+			{ID: 4, Type: "story"},
+			{ID: 5, Type: "comment", Parent: 4},
+		}))
+
+		item, err := store.GetItem(ctx, 4)
+		require.NoError(t, err)
+		assert.Nil(t, item)
+
+		require.NoError(t, snapshot.Commit(ctx))
+
+		saved, err := store.GetItems(ctx, []int{4, 5})
+		require.NoError(t, err)
+		assert.Len(t, saved, 2)
+	})
+}
+
+func TestStatus(t *testing.T) {
+	ctx := context.Background()
+	store, mr := newTestStore(t)
+
+	t.Run("Ping succeeds when redis is up", func(t *testing.T) {
+		require.NoError(t, store.Ping(ctx))
+	})
+
+	t.Run("Ping fails when redis is down", func(t *testing.T) {
+		mr.Close()
+
+		assert.Error(t, store.Ping(ctx))
+
+		_, err := store.Status(ctx)
+		assert.Error(t, err)
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	store, mr := newTestStore(t)
+
+	require.NoError(t, mr.Set("hn_item_story_10", `{"id":10,"type":"story"}`))
+	require.NoError(t, mr.Set("hn_item_comment_11", `{"id":11,"type":"comment"}`))
+
+	migrated, err := store.Migrate(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 6, migrated)
+	assert.False(t, mr.Exists("hn_item_story_10"))
+	assert.True(t, mr.Exists("hn_item_10"))
+
+	item, err := store.GetItem(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, "story", item.Type)
+
+	posts, err := store.GetAllPosts(ctx, nil, server.ListQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, []int{10}, posts.IDs)
+
+	migrated, err = store.Migrate(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, migrated)
+}
+
+func TestMigrateToHashTaggedIndexes(t *testing.T) {
+	ctx := context.Background()
+	store, mr := newTestStore(t)
+
+	require.NoError(t, mr.Set("hn_schema_version", "3"))
+	require.NoError(t, mr.Set("hn_item_12", `{"id":12,"type":"story","by":"bob","score":5}`))
+	_, err := mr.ZAdd("hn_index_items", 12, "12")
+	require.NoError(t, err)
+	_, err = mr.ZAdd("hn_index_by_bob", 12, "12")
+	require.NoError(t, err)
+
+	migrated, err := store.Migrate(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, migrated)
+
+	assert.False(t, mr.Exists("hn_index_items"))
+	assert.False(t, mr.Exists("hn_index_by_bob"))
+
+	posts, err := store.GetAllPosts(ctx, nil, server.ListQuery{By: "bob"})
+	require.NoError(t, err)
+	assert.Equal(t, []int{12}, posts.IDs)
+}
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	store, mr := newTestStore(t)
+
+	items := []*scraper.ItemResponse{
+		{ID: 1, Type: "story", By: "alice", Score: 50, Time: 1000, Descendants: 3},
+		{ID: 2, Type: "story", By: "bob", Score: 10, Time: 2000, Descendants: 8},
+		{ID: 3, Type: "job", By: "alice", Score: 30, Time: 3000},
+		{ID: 4, Type: "comment", By: "alice", Time: 4000, Parent: 1},
+		{ID: 5, Type: "poll", By: "bob", Score: 70, Time: 5000, Descendants: 1},
+	}
+	for _, item := range items {
+		require.NoError(t, store.SaveItem(ctx, item))
+	}
+
+	minScore := 20
+
+	type test struct {
+		postType *string
+		query    server.ListQuery
+		expected server.ListResult
+	}
+
+	story := "story"
+	tests := map[string]test{
+		"Posts sorted by score descending": {query: server.ListQuery{Sort: server.SortScore, Desc: true}, expected: server.ListResult{IDs: []int{5, 1, 3, 2}, Total: 4}},
+		"Posts sorted by time ascending":   {query: server.ListQuery{Sort: server.SortTime}, expected: server.ListResult{IDs: []int{1, 2, 3, 5}, Total: 4}},
+		"Posts sorted by descendants":      {query: server.ListQuery{Sort: server.SortDescendants, Desc: true}, expected: server.ListResult{IDs: []int{2, 1, 5, 3}, Total: 4}},
+		"Posts filtered by author":         {query: server.ListQuery{By: "alice"}, expected: server.ListResult{IDs: []int{1, 3}, Total: 2}},
+		"Posts filtered by type":           {query: server.ListQuery{Type: "poll"}, expected: server.ListResult{IDs: []int{5}, Total: 1}},
+		"Posts filtered by min score":      {query: server.ListQuery{MinScore: &minScore}, expected: server.ListResult{IDs: []int{1, 3, 5}, Total: 3}},
+		"Posts filtered by time range":     {query: server.ListQuery{Since: 2000, Until: 3000}, expected: server.ListResult{IDs: []int{2, 3}, Total: 2}},
+		"Posts filtered by score and time": {query: server.ListQuery{Sort: server.SortTime, Desc: true, MinScore: &minScore, Until: 4000}, expected: server.ListResult{IDs: []int{3, 1}, Total: 2}},
+		"Posts paginated after sorting":    {query: server.ListQuery{Sort: server.SortScore, Desc: true, Offset: 1, Limit: 2}, expected: server.ListResult{IDs: []int{1, 3}, Total: 4}},
+		"Stories filtered by author":       {postType: &story, query: server.ListQuery{By: "bob"}, expected: server.ListResult{IDs: []int{2}, Total: 1}},
+		"Posts with no matches":            {query: server.ListQuery{By: "nobody"}, expected: server.ListResult{IDs: []int{}, Total: 0}},
+	}
+
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := store.GetAllPosts(ctx, opts.postType, opts.query)
+
+			require.NoError(t, err)
+			assert.Equal(t, opts.expected, result)
+		})
+	}
+
+	t.Run("Items filtered by author include comments", func(t *testing.T) {
+		result, err := store.GetAllItems(ctx, server.ListQuery{By: "alice", Sort: server.SortTime, Desc: true})
+
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{4, 3, 1}, Total: 3}, result)
+	})
+
+	t.Run("Queries reuse their results until the data is written", func(t *testing.T) {
+		query := server.ListQuery{By: "bob", Sort: server.SortScore}
+		_, err := store.GetAllPosts(ctx, nil, query)
+		require.NoError(t, err)
+
+		// Tamper with the stored result to tell whether it is rebuilt.
+		for _, key := range mr.Keys() {
+			if strings.Contains(key, "query_") {
+				_, err = mr.ZAdd(key, 100, "100")
+				require.NoError(t, err)
+			}
+		}
+
+		result, err := store.GetAllPosts(ctx, nil, query)
+		require.NoError(t, err)
+		assert.Equal(t, []int{2, 5, 100}, result.IDs)
+
+		require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 6, Type: "story", By: "carol"}))
+
+		result, err = store.GetAllPosts(ctx, nil, query)
+		require.NoError(t, err)
+		assert.Equal(t, []int{2, 5}, result.IDs)
+	})
+
+	t.Run("Deleted items are removed from author index", func(t *testing.T) {
+		require.NoError(t, store.DeleteItem(ctx, &scraper.ItemResponse{ID: 3, Deleted: true}))
+
+		result, err := store.GetAllPosts(ctx, nil, server.ListQuery{By: "alice"})
+
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{1}, Total: 1}, result)
+	})
+}
+
+func TestFeeds(t *testing.T) {
+	ctx := context.Background()
+	store, mr := newTestStore(t)
+
+	require.NoError(t, store.SaveTopStories(ctx, scraper.TopStoriesResponse{30, 10, 20}))
+	require.NoError(t, store.SaveFeed(ctx, scraper.FeedAsk, []int{5}))
+
+	t.Run("Feeds are returned in rank order", func(t *testing.T) {
+		result, err := store.GetTopStories(ctx, server.ListQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{30, 10, 20}, Total: 3}, result)
+
+		result, err = store.GetFeed(ctx, scraper.FeedTop, server.ListQuery{Offset: 1, Limit: 1})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{10}, Total: 3}, result)
+	})
+
+	t.Run("Saving a feed replaces the previous ranking", func(t *testing.T) {
+		require.NoError(t, store.SaveFeed(ctx, scraper.FeedAsk, []int{7, 6}))
+
+		result, err := store.GetFeed(ctx, scraper.FeedAsk, server.ListQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{7, 6}, Total: 2}, result)
+	})
+
+	t.Run("Feeds saved as json are migrated to lists", func(t *testing.T) {
+		mr.Del("hn_show_stories")
+		require.NoError(t, mr.Set("hn_show_stories", "[3,2,1]"))
+
+		_, err := store.Migrate(ctx)
+		require.NoError(t, err)
+
+		result, err := store.GetFeed(ctx, scraper.FeedShow, server.ListQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{3, 2, 1}, Total: 3}, result)
+	})
+}
+
+func mustZMembers(t *testing.T, mr *miniredis.Miniredis, key string) []string {
+	members, err := mr.ZMembers(key)
+	require.NoError(t, err)
+	return members
+}
+
+func TestCacheMetrics(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newTestStore(t)
+
+	generate := func(ctx context.Context) (interface{}, error) {
+		return "value", nil
+	}
+
+	var value string
+	require.NoError(t, store.Cache(ctx, "key", time.Minute, &value, generate))
+	require.NoError(t, store.Cache(ctx, "key", time.Minute, &value, generate))
+
+	t.Run("Cache counts hits and misses", func(t *testing.T) {
+		assert.Equal(t, float64(1), testutil.ToFloat64(store.metrics.cache.WithLabelValues("hit")))
+		assert.Equal(t, float64(1), testutil.ToFloat64(store.metrics.cache.WithLabelValues("miss")))
+	})
+}
+
+func TestCacheStampede(t *testing.T) {
+	ctx := context.Background()
+	store, mr := newTestStore(t)
+
+	t.Run("Cache coalesces concurrent misses", func(t *testing.T) {
+		var calls int32
+		release := make(chan struct{})
+		generate := func(ctx context.Context) (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return "value", nil
+		}
+
+		var wg sync.WaitGroup
+		results := make([]string, 10)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				assert.NoError(t, store.Cache(ctx, "coalesced", time.Minute, &results[i], generate))
+			}(i)
+		}
+
+		time.Sleep(time.Millisecond * 20)
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+		for _, result := range results {
+			assert.Equal(t, "value", result)
+		}
+		assert.False(t, mr.Exists("hn_cache_lock_coalesced"))
+	})
+
+	t.Run("Cache waits for other replicas holding the lock", func(t *testing.T) {
+		require.NoError(t, mr.Set("hn_cache_lock_locked", "other"))
+		go func() {
+			time.Sleep(time.Millisecond * 100)
+			entry := fmt.Sprintf(`{"data":"from replica","fresh_until":%d}`, time.Now().Add(time.Minute).UnixNano())
+			assert.NoError(t, mr.Set("locked", entry))
+			mr.Del("hn_cache_lock_locked")
+		}()
+
+		var value string
+		err := store.Cache(ctx, "locked", time.Minute, &value, func(ctx context.Context) (interface{}, error) {
+			return "generated", nil
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, "from replica", value)
+	})
+
+	t.Run("Cache generates values when the lock is released without a value", func(t *testing.T) {
+		require.NoError(t, mr.Set("hn_cache_lock_released", "other"))
+		go func() {
+			time.Sleep(time.Millisecond * 100)
+			mr.Del("hn_cache_lock_released")
+		}()
+
+		var value string
+		err := store.Cache(ctx, "released", time.Minute, &value, func(ctx context.Context) (interface{}, error) {
+			return "generated", nil
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, "generated", value)
+	})
+
+	t.Run("Cache cancels generation once every waiting request has gone", func(t *testing.T) {
+		cancelled := make(chan struct{})
+		generate := func(ctx context.Context) (interface{}, error) {
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, time.Millisecond*20)
+		defer cancel()
+
+		var value string
+		err := store.Cache(reqCtx, "abandoned", time.Minute, &value, generate)
+
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("generation was not cancelled")
+		}
+		assert.Eventually(t, func() bool {
+			return !mr.Exists("hn_cache_lock_abandoned")
+		}, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("Cache keeps generating while another request is waiting", func(t *testing.T) {
+		release := make(chan struct{})
+		generate := func(ctx context.Context) (interface{}, error) {
+			select {
+			case <-release:
+				return "value", nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		leaving, leave := context.WithCancel(ctx)
+		left := make(chan error, 1)
+		go func() {
+			var value string
+			left <- store.Cache(leaving, "shared", time.Minute, &value, generate)
+		}()
+
+		var value string
+		waited := make(chan error, 1)
+		go func() {
+			waited <- store.Cache(ctx, "shared", time.Minute, &value, generate)
+		}()
+
+		time.Sleep(time.Millisecond * 20)
+		leave()
+		assert.ErrorIs(t, <-left, context.Canceled)
+
+		close(release)
+		require.NoError(t, <-waited)
+		assert.Equal(t, "value", value)
+	})
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	ctx := context.Background()
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	store := NewRedisStore(
+		WithRedisOptions(&redis.Options{
+			Addr: mr.Addr(),
+		}),
+		WithStaleWhileRevalidate(time.Minute),
+	)
+
+	var calls int32
+	generate := func(ctx context.Context) (interface{}, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	}
+
+	var value int
+	require.NoError(t, store.Cache(ctx, "stale", time.Millisecond*50, &value, generate))
+	assert.Equal(t, 1, value)
+
+	time.Sleep(time.Millisecond * 60)
+
+	t.Run("Cache serves stale values while refreshing them", func(t *testing.T) {
+		require.NoError(t, store.Cache(ctx, "stale", time.Millisecond*50, &value, generate))
+		assert.Equal(t, 1, value)
+		assert.Equal(t, float64(1), testutil.ToFloat64(store.metrics.cache.WithLabelValues("stale")))
+
+		assert.Eventually(t, func() bool {
+			var refreshed int
+			require.NoError(t, store.Cache(ctx, "stale", time.Minute, &refreshed, generate))
+			return refreshed == 2
+		}, time.Second, time.Millisecond*10)
+	})
+
+	t.Run("Cache does not serve stale values once a scrape finishes", func(t *testing.T) {
+		require.NoError(t, store.Cache(ctx, "scraped", time.Millisecond*50, &value, generate))
+		before := atomic.LoadInt32(&calls)
+
+		time.Sleep(time.Millisecond * 60)
+		require.NoError(t, store.SaveLastScrape(ctx, time.Now()))
+
+		require.NoError(t, store.Cache(ctx, "scraped", time.Millisecond*50, &value, generate))
+		assert.Equal(t, int(before+1), value)
+	})
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+	store, mr := newTestStore(t)
+
+	calls := 0
+	generate := func(ctx context.Context) (interface{}, error) {
+		calls++
+		return calls, nil
+	}
+
+	var value int
+	require.NoError(t, store.Cache(ctx, "key", time.Minute, &value, generate))
+	require.NoError(t, store.Cache(ctx, "key", time.Minute, &value, generate))
+	assert.Equal(t, 1, value)
+
+	t.Run("Writes do not bump the data generation", func(t *testing.T) {
+		require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 1, Type: "story"}))
+		require.NoError(t, store.DeleteItem(ctx, &scraper.ItemResponse{ID: 1, Deleted: true}))
+		require.NoError(t, store.SaveTopStories(ctx, scraper.TopStoriesResponse{1}))
+		require.NoError(t, store.SaveUser(ctx, &scraper.UserResponse{ID: "alice"}))
+
+		require.NoError(t, store.Cache(ctx, "key", time.Minute, &value, generate))
+		assert.Equal(t, 1, value)
+		assert.False(t, mr.Exists("hn_generation"))
+	})
+
+	t.Run("Finishing a scrape bumps the data generation once", func(t *testing.T) {
+		require.NoError(t, store.SaveLastScrape(ctx, time.Now()))
+
+		require.NoError(t, store.Cache(ctx, "key", time.Minute, &value, generate))
+		assert.Equal(t, 2, value)
+
+		generation, err := mr.Get("hn_generation")
+		require.NoError(t, err)
+		assert.Equal(t, "1", generation)
+	})
+}
+
+func TestSnapshots(t *testing.T) {
+	ctx := context.Background()
+	store, mr := newTestStore(t)
+
+	var items []*scraper.ItemResponse
+	for id := 1; id <= copyChunk*2+50; id++ {
+		items = append(items, &scraper.ItemResponse{ID: id, Type: "comment", By: "alice"})
+	}
+	require.NoError(t, store.SaveItems(ctx, items))
+	require.NoError(t, store.SaveUser(ctx, &scraper.UserResponse{ID: "alice"}))
+	require.NoError(t, store.SaveTopStories(ctx, scraper.TopStoriesResponse{1}))
+	require.NoError(t, store.SaveMaxItem(ctx, len(items)))
+
+	t.Run("Snapshots copy more than a chunk of the live data", func(t *testing.T) {
+		snapshot, err := store.Snapshot(ctx)
+		require.NoError(t, err)
+		require.NoError(t, snapshot.SaveItem(ctx, &scraper.ItemResponse{ID: len(items) + 1, Type: "story", By: "alice"}))
+		require.NoError(t, snapshot.Commit(ctx))
+
+		result, err := store.GetAllItems(ctx, server.ListQuery{By: "alice"})
+		require.NoError(t, err)
+		assert.Equal(t, len(items)+1, result.Total)
+
+		result, err = store.GetTopStories(ctx, server.ListQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, []int{1}, result.IDs)
+
+		user, err := store.GetUser(ctx, "alice")
+		require.NoError(t, err)
+		assert.NotNil(t, user)
+
+		maxItem, err := store.LastMaxItem(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, len(items), maxItem)
+	})
+
+	t.Run("Only the live and previous keyspaces are kept", func(t *testing.T) {
+		snapshot, err := store.Snapshot(ctx)
+		require.NoError(t, err)
+		require.NoError(t, snapshot.SaveMaxItem(ctx, len(items)+1))
+		require.NoError(t, snapshot.Commit(ctx))
+
+		current, err := mr.Get("hn_current")
+		require.NoError(t, err)
+		previous, err := mr.Get("hn_previous")
+		require.NoError(t, err)
+
+		for _, key := range mr.Keys() {
+			if strings.HasPrefix(key, "{hn_index") {
+				assert.True(t, strings.HasPrefix(key, "{hn_index_"+current+"}") || strings.HasPrefix(key, "{hn_index_"+previous+"}"), key)
+			}
+		}
+		assert.False(t, mr.Exists("hn_item_1"))
+		assert.False(t, mr.Exists("hn_staged"))
+	})
+
+	t.Run("Committing fails if the live data was written to after it was copied", func(t *testing.T) {
+		conflicting, err := store.Snapshot(ctx)
+		require.NoError(t, err)
+		require.NoError(t, conflicting.SaveItem(ctx, &scraper.ItemResponse{ID: 10000, Type: "story"}))
+		require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 10001, Type: "story"}))
+
+		assert.Equal(t, errKeyspaceChanged, conflicting.Commit(ctx))
+		require.NoError(t, conflicting.Discard(ctx))
+
+		saved, err := store.GetItems(ctx, []int{10000, 10001})
+		require.NoError(t, err)
+		assert.Nil(t, saved[0])
+		assert.NotNil(t, saved[1])
+	})
+
+	t.Run("Abandoned snapshots are dropped", func(t *testing.T) {
+		mr.HSet("hn_staged", "abandoned", strconv.FormatInt(time.Now().Add(-snapshotTTL).Unix(), 10))
+		require.NoError(t, mr.Set("hn_abandoned_item_1", "{}"))
+
+		snapshot, err := store.Snapshot(ctx)
+		require.NoError(t, err)
+		require.NoError(t, snapshot.Discard(ctx))
+
+		assert.False(t, mr.Exists("hn_abandoned_item_1"))
+		assert.False(t, mr.Exists("hn_staged"))
+	})
+}
+
+func TestClusterSnapshots(t *testing.T) {
+	ctx := context.Background()
+	store := NewRedisStore(WithRedis(redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{"127.0.0.1:7000"}})))
+
+	_, err := store.Snapshot(ctx)
+	assert.Equal(t, errClusterSnapshots, err)
+	assert.Equal(t, errClusterSnapshots, store.Rollback(ctx))
+}
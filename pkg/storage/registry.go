@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Opener opens a store from its parsed DSN, applying opts.
+type Opener func(dsn *url.URL, opts ...Option) (Store, error)
+
+var (
+	openersMu sync.RWMutex
+	openers   = map[string]Opener{
+		"redis":           openRedis,
+		"rediss":          openRedis,
+		"redis+sentinel":  openRedis,
+		"rediss+sentinel": openRedis,
+		"redis+cluster":   openRedis,
+		"rediss+cluster":  openRedis,
+		"memory":          openMemory,
+		"file":            openBolt,
+	}
+)
+
+// Register makes a store available to Open for DSNs with the given URL
+// scheme. Registering a scheme twice panics.
+func Register(scheme string, opener Opener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+
+	if _, ok := openers[scheme]; ok {
+		panic(fmt.Errorf("storage: a store is already registered for %s://", scheme))
+	}
+
+	openers[scheme] = opener
+}
+
+// Open opens the store described by dsn, using the store registered for its
+// URL scheme. The built in stores are:
+//
+//	redis://[[user]:password@]host[:port][/db][?option=value]
+//	redis+sentinel://[[user]:password@]host[:port][,host[:port]...][/db]?master=name[&option=value]
+//	redis+cluster://[[user]:password@]host[:port][,host[:port]...][?option=value]
+//	rediss://, rediss+sentinel://, rediss+cluster:// (the same over tls)
+//	memory://
+//	file:///path/to/hackernews.db (or file://hackernews.db, relative to the working directory)
+//
+// Redis DSNs accept the pool_size, dial_timeout, read_timeout and
+// write_timeout options, with timeouts given as durations such as 5s.
+// Sentinel DSNs list the sentinels, and also accept sentinel_password.
+func Open(dsn string, opts ...Option) (Store, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("storage: invalid store dsn: %s", err)
+	}
+
+	openersMu.RLock()
+	opener, ok := openers[u.Scheme]
+	openersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("storage: no store registered for %q, expected one of %s", u.Scheme, strings.Join(schemes(), ", "))
+	}
+
+	return opener(u, opts...)
+}
+
+func schemes() []string {
+	openersMu.RLock()
+	defer openersMu.RUnlock()
+
+	var schemes []string
+	for scheme := range openers {
+		schemes = append(schemes, scheme+"://")
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+func openRedis(dsn *url.URL, opts ...Option) (Store, error) {
+	redisOptions, err := parseRedisDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	var client redis.UniversalClient
+	switch redisTopology(dsn) {
+	case "sentinel":
+		client = redis.NewFailoverClient(redisOptions.Failover())
+	case "cluster":
+		client = redis.NewClusterClient(redisOptions.Cluster())
+	default:
+		client = redis.NewClient(redisOptions.Simple())
+	}
+
+	return NewRedisStore(append(opts, WithRedis(client))...), nil
+}
+
+// redisTopology is the part of a redis DSN scheme after the +, if any.
+func redisTopology(dsn *url.URL) string {
+	parts := strings.SplitN(dsn.Scheme, "+", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+
+	return parts[1]
+}
+
+// parseRedisDSN parses the addresses, credentials, database and tls settings
+// of dsn, then applies the options in its query.
+func parseRedisDSN(dsn *url.URL) (*redis.UniversalOptions, error) {
+	topology := redisTopology(dsn)
+
+	defaultPort := "6379"
+	if topology == "sentinel" {
+		defaultPort = "26379"
+	}
+
+	redisOptions := &redis.UniversalOptions{}
+	for _, addr := range strings.Split(dsn.Host, ",") {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			host, port = strings.Trim(addr, "[]"), defaultPort
+		}
+		if host == "" {
+			host = "localhost"
+		}
+
+		redisOptions.Addrs = append(redisOptions.Addrs, net.JoinHostPort(host, port))
+	}
+	if topology == "" && len(redisOptions.Addrs) > 1 {
+		return nil, fmt.Errorf("storage: invalid redis dsn: more than one host, use redis+sentinel:// or redis+cluster://")
+	}
+
+	if dsn.User != nil {
+		redisOptions.Username = dsn.User.Username()
+		redisOptions.Password, _ = dsn.User.Password()
+	}
+
+	if db := strings.Trim(dsn.Path, "/"); db != "" {
+		if topology == "cluster" {
+			return nil, fmt.Errorf("storage: invalid redis dsn: redis cluster has no databases to select")
+		}
+
+		var err error
+		redisOptions.DB, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("storage: invalid redis dsn: invalid database number: %q", db)
+		}
+	}
+
+	// The server name is left empty so that each connection verifies the
+	// certificate against the host it dials, which differs between sentinels,
+	// the master they return and the nodes of a cluster.
+	if strings.HasPrefix(dsn.Scheme, "rediss") {
+		redisOptions.TLSConfig = &tls.Config{}
+	}
+
+	for option := range dsn.Query() {
+		value := dsn.Query().Get(option)
+
+		var err error
+		switch {
+		case option == "pool_size":
+			redisOptions.PoolSize, err = strconv.Atoi(value)
+		case option == "dial_timeout":
+			redisOptions.DialTimeout, err = time.ParseDuration(value)
+		case option == "read_timeout":
+			redisOptions.ReadTimeout, err = time.ParseDuration(value)
+		case option == "write_timeout":
+			redisOptions.WriteTimeout, err = time.ParseDuration(value)
+		case option == "master" && topology == "sentinel":
+			redisOptions.MasterName = value
+		case option == "sentinel_password" && topology == "sentinel":
+			redisOptions.SentinelPassword = value
+		default:
+			return nil, fmt.Errorf("storage: unknown redis option %q", option)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("storage: invalid redis option %s: %s", option, err)
+		}
+	}
+
+	if topology == "sentinel" && redisOptions.MasterName == "" {
+		return nil, fmt.Errorf("storage: invalid redis dsn: sentinel dsns need a master option")
+	}
+
+	return redisOptions, nil
+}
+
+func openMemory(dsn *url.URL, opts ...Option) (Store, error) {
+	return NewMemoryStore(opts...), nil
+}
+
+func openBolt(dsn *url.URL, opts ...Option) (Store, error) {
+	path := dsn.Opaque
+	if path == "" {
+		path = dsn.Host + dsn.Path
+	}
+	if path == "" {
+		return nil, fmt.Errorf("storage: file store dsn has no path")
+	}
+
+	store, err := NewBoltStore(path, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
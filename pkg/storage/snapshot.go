@@ -0,0 +1,434 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jralph/hackernews-api/internal/scraper"
+)
+
+// snapshotTTL is how long the keyspace of a snapshot is kept if it is never
+// committed or discarded, before a later snapshot drops it.
+const snapshotTTL = time.Hour * 24
+
+// copyChunk is the most keys copied or deleted by each round trip when the
+// live keyspace is copied into a snapshot, or a keyspace is dropped.
+const copyChunk = 1000
+
+const (
+	// currentKeyspaceKey names the live keyspace. Committing a snapshot
+	// points it at the keyspace the snapshot was staged in, switching every
+	// reader to the new data at once. Without it the unnamed keyspace is live.
+	currentKeyspaceKey = keyPrefix + "current"
+
+	// previousKeyspaceKey names the keyspace replaced by the last commit or
+	// rollback, which is kept so that it can be rolled back to.
+	previousKeyspaceKey = keyPrefix + "previous"
+
+	// stagedKeyspacesKey is a hash of the keyspaces of snapshots that have not
+	// been committed or discarded, to the unix time they were taken at.
+	stagedKeyspacesKey = keyPrefix + "staged"
+)
+
+var (
+	errNoPreviousSnapshot = errors.New("storage: no previous snapshot to roll back to")
+	errKeyspaceChanged    = errors.New("storage: the live data was written to or replaced while switching keyspaces")
+	errClusterSnapshots   = errors.New("storage: snapshots are not supported on redis cluster, as copying the indexes spans several slots")
+)
+
+// snapshot stages writes in a copy of the live keyspace until it is
+// committed.
+type snapshot struct {
+	staged *Redis
+	keys   keyspace
+
+	// live is the keyspace copied, and writes the number of writes it had
+	// when it was copied.
+	live   keyspace
+	writes int64
+}
+
+// Snapshot copies the live keyspace into a new one that writes are staged
+// in. The copy takes a round trip per copyChunk keys, and the memory used by
+// the data doubles until the snapshot is committed or discarded. Snapshots
+// are not supported on a redis cluster.
+func (r *Redis) Snapshot(ctx context.Context) (scraper.Snapshot, error) {
+	if _, ok := r.client.(*redis.ClusterClient); ok {
+		return nil, errClusterSnapshots
+	}
+
+	err := r.dropAbandonedSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	keys := keyspace{name: name}
+
+	err = r.client.HSet(ctx, stagedKeyspacesKey, name, time.Now().Unix()).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	live, err := r.keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Count the writes before copying, so that any made while copying are
+	// caught when committing.
+	writes, err := countWrites(ctx, r.client, live)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.copyKeyspace(ctx, live, keys)
+	if err != nil {
+		// Left for a later snapshot to drop if this fails too.
+		_ = r.dropKeyspace(context.Background(), keys)
+
+		return nil, err
+	}
+
+	return &snapshot{staged: r.pin(keys), keys: keys, live: live, writes: writes}, nil
+}
+
+func (s *snapshot) SaveFeed(ctx context.Context, feed scraper.Feed, items []int) error {
+	return s.staged.SaveFeed(ctx, feed, items)
+}
+
+func (s *snapshot) SaveItem(ctx context.Context, item *scraper.ItemResponse) error {
+	return s.staged.SaveItem(ctx, item)
+}
+
+func (s *snapshot) SaveItems(ctx context.Context, items []*scraper.ItemResponse) error {
+	return s.staged.SaveItems(ctx, items)
+}
+
+func (s *snapshot) DeleteItem(ctx context.Context, item *scraper.ItemResponse) error {
+	return s.staged.DeleteItem(ctx, item)
+}
+
+func (s *snapshot) SaveUser(ctx context.Context, user *scraper.UserResponse) error {
+	return s.staged.SaveUser(ctx, user)
+}
+
+func (s *snapshot) LastMaxItem(ctx context.Context) (int, error) {
+	return s.staged.LastMaxItem(ctx)
+}
+
+func (s *snapshot) SaveMaxItem(ctx context.Context, id int) error {
+	return s.staged.SaveMaxItem(ctx, id)
+}
+
+func (s *snapshot) SaveLastScrape(ctx context.Context, at time.Time) error {
+	return s.staged.SaveLastScrape(ctx, at)
+}
+
+// Commit switches readers to the staged keyspace in a single transaction,
+// keeping the live keyspace to roll back to and dropping the one kept
+// before. It fails if the live keyspace was written to or replaced since it
+// was copied, as those writes would be lost. A snapshot nothing was written
+// to is discarded instead, keeping the previous snapshot.
+func (s *snapshot) Commit(ctx context.Context) error {
+	r := s.staged
+
+	written, err := countWrites(ctx, r.client, s.keys)
+	if err != nil {
+		return err
+	}
+	if written == 0 {
+		return s.Discard(ctx)
+	}
+
+	replaced := ""
+	hasReplaced := false
+	err = r.client.Watch(ctx, func(tx *redis.Tx) error {
+		live, err := currentKeyspace(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		writes, err := countWrites(ctx, tx, s.live)
+		if err != nil {
+			return err
+		}
+		if live != s.live || writes != s.writes {
+			return errKeyspaceChanged
+		}
+
+		replaced, err = tx.Get(ctx, previousKeyspaceKey).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		hasReplaced = err == nil
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, currentKeyspaceKey, s.keys.name, 0)
+			pipe.Set(ctx, previousKeyspaceKey, s.live.name, 0)
+			pipe.HDel(ctx, stagedKeyspacesKey, s.keys.name)
+			pipe.Incr(ctx, generationKey)
+
+			return nil
+		})
+
+		return err
+	}, currentKeyspaceKey, previousKeyspaceKey, s.live.writes())
+	if err == redis.TxFailedErr {
+		return errKeyspaceChanged
+	}
+	if err != nil || !hasReplaced {
+		return err
+	}
+
+	return r.dropKeyspace(ctx, keyspace{name: replaced})
+}
+
+func (s *snapshot) Discard(ctx context.Context) error {
+	err := s.staged.dropKeyspace(ctx, s.keys)
+	if err != nil {
+		return err
+	}
+
+	return s.staged.client.HDel(ctx, stagedKeyspacesKey, s.keys.name).Err()
+}
+
+// Rollback switches readers back to the previous keyspace in a single
+// transaction, keeping the one it replaces as the previous keyspace, so
+// rolling back twice restores the last snapshot. It is not supported on a
+// redis cluster.
+func (r *Redis) Rollback(ctx context.Context) error {
+	if _, ok := r.client.(*redis.ClusterClient); ok {
+		return errClusterSnapshots
+	}
+
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		live, err := currentKeyspace(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		previous, err := tx.Get(ctx, previousKeyspaceKey).Result()
+		if err == redis.Nil {
+			return errNoPreviousSnapshot
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, currentKeyspaceKey, previous, 0)
+			pipe.Set(ctx, previousKeyspaceKey, live.name, 0)
+			pipe.Incr(ctx, generationKey)
+
+			return nil
+		})
+
+		return err
+	}, currentKeyspaceKey, previousKeyspaceKey)
+	if err == redis.TxFailedErr {
+		return errKeyspaceChanged
+	}
+
+	return err
+}
+
+// dropAbandonedSnapshots drops the keyspaces of snapshots taken more than
+// snapshotTTL ago that were never committed or discarded, such as those of a
+// scraper that stopped mid scrape.
+func (r *Redis) dropAbandonedSnapshots(ctx context.Context) error {
+	staged, err := r.client.HGetAll(ctx, stagedKeyspacesKey).Result()
+	if err != nil {
+		return err
+	}
+
+	for name, at := range staged {
+		takenAt, err := strconv.ParseInt(at, 10, 64)
+		if err == nil && time.Since(time.Unix(takenAt, 0)) < snapshotTTL {
+			continue
+		}
+
+		err = r.dropKeyspace(ctx, keyspace{name: name})
+		if err != nil {
+			return err
+		}
+
+		err = r.client.HDel(ctx, stagedKeyspacesKey, name).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyKeyspace copies the items, users, feeds, scrape state and indexes in
+// from to to. The sorted sets cached for queries are not copied.
+func (r *Redis) copyKeyspace(ctx context.Context, from keyspace, to keyspace) error {
+	for _, pattern := range []string{"item_*", "user_*"} {
+		err := r.scanChunks(ctx, from.prefix()+pattern, func(keys []string) error {
+			return r.copyValues(ctx, from, to, keys)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := r.copyValues(ctx, from, to, []string{from.maxItem(), from.lastScrape()})
+	if err != nil {
+		return err
+	}
+
+	err = r.copyFeeds(ctx, from, to)
+	if err != nil {
+		return err
+	}
+
+	return r.scanChunks(ctx, from.indexPrefix()+"*", func(keys []string) error {
+		_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys {
+				if strings.HasPrefix(key, from.indexPrefix()+"query_") {
+					continue
+				}
+
+				index := to.indexPrefix() + strings.TrimPrefix(key, from.indexPrefix())
+				pipe.ZUnionStore(ctx, index, &redis.ZStore{Keys: []string{key}})
+			}
+
+			return nil
+		})
+
+		return err
+	})
+}
+
+func (r *Redis) copyValues(ctx context.Context, from keyspace, to keyspace, keys []string) error {
+	values, err := getAll(ctx, r.client, keys)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			if values[i] != "" {
+				pipe.Set(ctx, to.prefix()+strings.TrimPrefix(key, from.prefix()), values[i], 0)
+			}
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+func (r *Redis) copyFeeds(ctx context.Context, from keyspace, to keyspace) error {
+	feeds := map[scraper.Feed]*redis.StringSliceCmd{}
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, feed := range scraper.Feeds {
+			feeds[feed] = pipe.LRange(ctx, from.feed(feed), 0, -1)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for feed, members := range feeds {
+			if len(members.Val()) == 0 {
+				continue
+			}
+
+			items := make([]interface{}, 0, len(members.Val()))
+			for _, member := range members.Val() {
+				items = append(items, member)
+			}
+			pipe.RPush(ctx, to.feed(feed), items...)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// dropKeyspace deletes every key in keys.
+func (r *Redis) dropKeyspace(ctx context.Context, keys keyspace) error {
+	fixed := []string{keys.maxItem(), keys.lastScrape(), keys.writes()}
+	for _, feed := range scraper.Feeds {
+		fixed = append(fixed, keys.feed(feed))
+	}
+
+	err := r.client.Del(ctx, fixed...).Err()
+	if err != nil {
+		return err
+	}
+
+	for _, pattern := range []string{keys.prefix() + "item_*", keys.prefix() + "user_*", keys.indexPrefix() + "*"} {
+		err = r.scanChunks(ctx, pattern, func(chunk []string) error {
+			return r.client.Del(ctx, chunk...).Err()
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scanChunks calls f with the keys matching pattern, up to copyChunk at a
+// time.
+func (r *Redis) scanChunks(ctx context.Context, pattern string, f func([]string) error) error {
+	var chunk []string
+	err := r.scanKeys(ctx, pattern, func(key string) error {
+		chunk = append(chunk, key)
+		if len(chunk) < copyChunk {
+			return nil
+		}
+
+		err := f(chunk)
+		chunk = nil
+
+		return err
+	})
+	if err != nil || len(chunk) == 0 {
+		return err
+	}
+
+	return f(chunk)
+}
+
+func currentKeyspace(ctx context.Context, client redis.Cmdable) (keyspace, error) {
+	name, err := client.Get(ctx, currentKeyspaceKey).Result()
+	if err == redis.Nil {
+		return keyspace{}, nil
+	}
+
+	return keyspace{name: name}, err
+}
+
+func countWrites(ctx context.Context, client redis.Cmdable, keys keyspace) (int64, error) {
+	writes, err := client.Get(ctx, keys.writes()).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+
+	return writes, err
+}
+
+func intMembers(ids []int) []interface{} {
+	members := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		members = append(members, id)
+	}
+
+	return members
+}
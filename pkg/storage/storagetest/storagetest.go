@@ -0,0 +1,479 @@
+// Package storagetest is a conformance suite that every storage backend must
+// pass, so that the scraper and the api behave the same whichever backend
+// they are given.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jralph/hackernews-api/internal/scraper"
+	"github.com/jralph/hackernews-api/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Store is the behaviour under test, implemented by every storage backend.
+type Store interface {
+	scraper.Saver
+	scraper.Snapshotter
+	server.Storage
+
+	Rollback(context.Context) error
+}
+
+// Run runs the suite against stores built by newStore, which must return a
+// new, empty store each time it is called.
+func Run(t *testing.T, newStore func(t *testing.T) Store) {
+	tests := map[string]func(*testing.T, Store){
+		"Items":     testItems,
+		"Users":     testUsers,
+		"Feeds":     testFeeds,
+		"Query":     testQuery,
+		"Status":    testStatus,
+		"Cache":     testCache,
+		"Snapshots": testSnapshots,
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test(t, newStore(t))
+		})
+	}
+}
+
+func testItems(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 1, Type: "story", By: "alice", Kids: []int{2}}))
+	require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 2, Type: "comment", By: "bob", Parent: 1}))
+	require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 3, Type: "job"}))
+
+	t.Run("Items are returned as saved", func(t *testing.T) {
+		item, err := store.GetItem(ctx, 1)
+		require.NoError(t, err)
+		assert.Equal(t, &scraper.ItemResponse{ID: 1, Type: "story", By: "alice", Kids: []int{2}}, item)
+	})
+
+	t.Run("Missing items are nil", func(t *testing.T) {
+		item, err := store.GetItem(ctx, 100)
+		require.NoError(t, err)
+		assert.Nil(t, item)
+	})
+
+	t.Run("Items are fetched in bulk in the requested order", func(t *testing.T) {
+		items, err := store.GetItems(ctx, []int{3, 100, 1})
+		require.NoError(t, err)
+		require.Len(t, items, 3)
+		assert.Equal(t, 3, items[0].ID)
+		assert.Nil(t, items[1])
+		assert.Equal(t, 1, items[2].ID)
+	})
+
+	t.Run("Saving an item replaces it", func(t *testing.T) {
+		require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 3, Type: "job", Score: 5}))
+
+		item, err := store.GetItem(ctx, 3)
+		require.NoError(t, err)
+		assert.Equal(t, 5, item.Score)
+	})
+
+	t.Run("Deleted items are replaced with tombstones", func(t *testing.T) {
+		require.NoError(t, store.DeleteItem(ctx, &scraper.ItemResponse{ID: 2, Deleted: true}))
+
+		item, err := store.GetItem(ctx, 2)
+		require.NoError(t, err)
+		assert.Equal(t, &scraper.ItemResponse{ID: 2, Parent: 1, Deleted: true}, item)
+
+		result, err := store.GetAllItems(ctx, server.ListQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{1, 3}, Total: 2}, result)
+	})
+
+	t.Run("Dead items are replaced with tombstones", func(t *testing.T) {
+		require.NoError(t, store.DeleteItem(ctx, &scraper.ItemResponse{ID: 3, Dead: true}))
+
+		item, err := store.GetItem(ctx, 3)
+		require.NoError(t, err)
+		assert.Equal(t, &scraper.ItemResponse{ID: 3, Dead: true}, item)
+
+		result, err := store.GetAllPosts(ctx, nil, server.ListQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{1}, Total: 1}, result)
+	})
+
+	t.Run("Max item is zero until saved", func(t *testing.T) {
+		maxItem, err := store.LastMaxItem(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, maxItem)
+
+		require.NoError(t, store.SaveMaxItem(ctx, 3))
+
+		maxItem, err = store.LastMaxItem(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 3, maxItem)
+	})
+}
+
+func testUsers(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	user := &scraper.UserResponse{ID: "alice", Karma: 10, Submitted: []int{1, 2}}
+	require.NoError(t, store.SaveUser(ctx, user))
+
+	t.Run("Users are returned as saved", func(t *testing.T) {
+		stored, err := store.GetUser(ctx, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, user, stored)
+	})
+
+	t.Run("Missing users are nil", func(t *testing.T) {
+		stored, err := store.GetUser(ctx, "nobody")
+		require.NoError(t, err)
+		assert.Nil(t, stored)
+	})
+}
+
+func testFeeds(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	require.NoError(t, store.SaveFeed(ctx, scraper.FeedTop, []int{30, 10, 20}))
+	require.NoError(t, store.SaveFeed(ctx, scraper.FeedAsk, []int{5}))
+
+	type test struct {
+		feed     scraper.Feed
+		query    server.ListQuery
+		expected server.ListResult
+	}
+
+	tests := map[string]test{
+		"Feeds are returned in rank order":       {feed: scraper.FeedTop, expected: server.ListResult{IDs: []int{30, 10, 20}, Total: 3}},
+		"Feeds are paginated":                    {feed: scraper.FeedTop, query: server.ListQuery{Offset: 1, Limit: 1}, expected: server.ListResult{IDs: []int{10}, Total: 3}},
+		"Pages past the end of a feed are empty": {feed: scraper.FeedTop, query: server.ListQuery{Offset: 5, Limit: 2}, expected: server.ListResult{IDs: []int{}, Total: 3}},
+		"Missing feeds are empty":                {feed: scraper.FeedShow, expected: server.ListResult{IDs: []int{}, Total: 0}},
+	}
+
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := store.GetFeed(ctx, opts.feed, opts.query)
+
+			require.NoError(t, err)
+			assert.Equal(t, opts.expected, result)
+		})
+	}
+
+	t.Run("Saving a feed replaces the previous ranking", func(t *testing.T) {
+		require.NoError(t, store.SaveFeed(ctx, scraper.FeedAsk, []int{7, 6}))
+
+		result, err := store.GetFeed(ctx, scraper.FeedAsk, server.ListQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{7, 6}, Total: 2}, result)
+	})
+
+	t.Run("Top stories are the top feed", func(t *testing.T) {
+		result, err := store.GetTopStories(ctx, server.ListQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{30, 10, 20}, Total: 3}, result)
+	})
+}
+
+func testQuery(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	items := []*scraper.ItemResponse{
+		{ID: 1, Type: "story", By: "alice", Score: 50, Time: 1000, Descendants: 3},
+		{ID: 2, Type: "story", By: "bob", Score: 10, Time: 2000, Descendants: 8},
+		{ID: 3, Type: "job", By: "alice", Score: 30, Time: 3000},
+		{ID: 4, Type: "comment", By: "alice", Time: 4000, Parent: 1},
+		{ID: 5, Type: "poll", By: "bob", Score: 70, Time: 5000, Descendants: 1},
+		{ID: 10, Type: "story", By: "carol", Score: 10, Time: 6000},
+	}
+	for _, item := range items {
+		require.NoError(t, store.SaveItem(ctx, item))
+	}
+
+	minScore := 20
+
+	type test struct {
+		postType *string
+		query    server.ListQuery
+		expected server.ListResult
+	}
+
+	story := "story"
+	tests := map[string]test{
+		"Posts sorted by id":                 {expected: server.ListResult{IDs: []int{1, 2, 3, 5, 10}, Total: 5}},
+		"Posts sorted by id descending":      {query: server.ListQuery{Desc: true}, expected: server.ListResult{IDs: []int{10, 5, 3, 2, 1}, Total: 5}},
+		"Posts sorted by score descending":   {query: server.ListQuery{Sort: server.SortScore, Desc: true}, expected: server.ListResult{IDs: []int{5, 1, 3, 2, 10}, Total: 5}},
+		"Posts with equal scores":            {query: server.ListQuery{Sort: server.SortScore, Limit: 2}, expected: server.ListResult{IDs: []int{10, 2}, Total: 5}},
+		"Posts sorted by time ascending":     {query: server.ListQuery{Sort: server.SortTime}, expected: server.ListResult{IDs: []int{1, 2, 3, 5, 10}, Total: 5}},
+		"Posts sorted by descendants":        {query: server.ListQuery{Sort: server.SortDescendants, Desc: true, Limit: 3}, expected: server.ListResult{IDs: []int{2, 1, 5}, Total: 5}},
+		"Posts filtered by author":           {query: server.ListQuery{By: "alice"}, expected: server.ListResult{IDs: []int{1, 3}, Total: 2}},
+		"Posts filtered by type":             {query: server.ListQuery{Type: "poll"}, expected: server.ListResult{IDs: []int{5}, Total: 1}},
+		"Posts filtered by min score":        {query: server.ListQuery{MinScore: &minScore}, expected: server.ListResult{IDs: []int{1, 3, 5}, Total: 3}},
+		"Posts filtered by time range":       {query: server.ListQuery{Since: 2000, Until: 3000}, expected: server.ListResult{IDs: []int{2, 3}, Total: 2}},
+		"Posts filtered by score and time":   {query: server.ListQuery{Sort: server.SortTime, Desc: true, MinScore: &minScore, Until: 4000}, expected: server.ListResult{IDs: []int{3, 1}, Total: 2}},
+		"Posts filtered by the sorted field": {query: server.ListQuery{Sort: server.SortScore, MinScore: &minScore}, expected: server.ListResult{IDs: []int{3, 1, 5}, Total: 3}},
+		"Posts paginated after sorting":      {query: server.ListQuery{Sort: server.SortScore, Desc: true, Offset: 1, Limit: 2}, expected: server.ListResult{IDs: []int{1, 3}, Total: 5}},
+		"Stories filtered by author":         {postType: &story, query: server.ListQuery{By: "bob"}, expected: server.ListResult{IDs: []int{2}, Total: 1}},
+		"Posts with no matches":              {query: server.ListQuery{By: "nobody"}, expected: server.ListResult{IDs: []int{}, Total: 0}},
+	}
+
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := store.GetAllPosts(ctx, opts.postType, opts.query)
+
+			require.NoError(t, err)
+			assert.Equal(t, opts.expected, result)
+		})
+	}
+
+	t.Run("Items include comments", func(t *testing.T) {
+		result, err := store.GetAllItems(ctx, server.ListQuery{By: "alice", Sort: server.SortTime, Desc: true})
+
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{4, 3, 1}, Total: 3}, result)
+	})
+
+	t.Run("Resaved items are reindexed", func(t *testing.T) {
+		require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 3, Type: "story", By: "alice", Score: 80, Time: 3000}))
+
+		result, err := store.GetAllPosts(ctx, &story, server.ListQuery{By: "alice"})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{1, 3}, Total: 2}, result)
+
+		jobs := "job"
+		result, err = store.GetAllPosts(ctx, &jobs, server.ListQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{}, Total: 0}, result)
+
+		result, err = store.GetAllPosts(ctx, nil, server.ListQuery{Sort: server.SortScore, Desc: true, Limit: 1})
+		require.NoError(t, err)
+		assert.Equal(t, server.ListResult{IDs: []int{3}, Total: 5}, result)
+	})
+}
+
+func testStatus(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	t.Run("Status reports an empty store", func(t *testing.T) {
+		require.NoError(t, store.Ping(ctx))
+
+		status, err := store.Status(ctx)
+		require.NoError(t, err)
+		assert.True(t, status.LastScrape.IsZero())
+		assert.Equal(t, 0, status.Items)
+	})
+
+	t.Run("Status reports the last scrape and item counts", func(t *testing.T) {
+		lastScrape := time.Unix(1612325106, 0)
+		require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 1, Type: "story"}))
+		require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 2, Type: "comment"}))
+		require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 3, Type: "comment"}))
+		require.NoError(t, store.DeleteItem(ctx, &scraper.ItemResponse{ID: 3, Deleted: true}))
+		require.NoError(t, store.SaveLastScrape(ctx, lastScrape.Add(time.Millisecond*500)))
+
+		status, err := store.Status(ctx)
+		require.NoError(t, err)
+		assert.True(t, lastScrape.Equal(status.LastScrape))
+		assert.Equal(t, 2, status.Items)
+		assert.Equal(t, map[string]int{"story": 1, "comment": 1, "job": 0, "poll": 0, "pollopt": 0}, status.Types)
+	})
+}
+
+func testCache(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	calls := 0
+	generate := func(ctx context.Context) (interface{}, error) {
+		calls++
+		return map[string]int{"calls": calls}, nil
+	}
+
+	t.Run("Cache only generates missing values", func(t *testing.T) {
+		var first, second map[string]int
+		require.NoError(t, store.Cache(ctx, "key", time.Minute, &first, generate))
+		require.NoError(t, store.Cache(ctx, "key", time.Minute, &second, generate))
+
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, map[string]int{"calls": 1}, second)
+	})
+
+	t.Run("Cache does not store errors", func(t *testing.T) {
+		var target map[string]int
+		err := store.Cache(ctx, "failing", time.Minute, &target, func(ctx context.Context) (interface{}, error) {
+			return nil, errors.New("failed")
+		})
+
+		assert.EqualError(t, err, "failed")
+		assert.Nil(t, target)
+	})
+
+	t.Run("Cache regenerates expired values", func(t *testing.T) {
+		var value map[string]int
+		require.NoError(t, store.Cache(ctx, "expiring", time.Millisecond*50, &value, generate))
+		before := calls
+
+		time.Sleep(time.Millisecond * 60)
+
+		require.NoError(t, store.Cache(ctx, "expiring", time.Millisecond*50, &value, generate))
+		assert.Equal(t, before+1, calls)
+	})
+
+	t.Run("Writes are not served until the scrape finishes", func(t *testing.T) {
+		var value map[string]int
+		require.NoError(t, store.Cache(ctx, "key", time.Minute, &value, generate))
+		before := calls
+
+		require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 1, Type: "story"}))
+		require.NoError(t, store.DeleteItem(ctx, &scraper.ItemResponse{ID: 1, Deleted: true}))
+		require.NoError(t, store.SaveFeed(ctx, scraper.FeedTop, []int{1}))
+		require.NoError(t, store.SaveUser(ctx, &scraper.UserResponse{ID: "alice"}))
+
+		require.NoError(t, store.Cache(ctx, "key", time.Minute, &value, generate))
+		assert.Equal(t, before, calls)
+	})
+
+	t.Run("Finishing a scrape invalidates the cache", func(t *testing.T) {
+		var value map[string]int
+		require.NoError(t, store.Cache(ctx, "key", time.Minute, &value, generate))
+		before := calls
+
+		require.NoError(t, store.SaveLastScrape(ctx, time.Now()))
+
+		require.NoError(t, store.Cache(ctx, "key", time.Minute, &value, generate))
+		assert.Equal(t, before+1, calls)
+
+		require.NoError(t, store.Cache(ctx, "key", time.Minute, &value, generate))
+		assert.Equal(t, before+1, calls)
+	})
+}
+
+func testSnapshots(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	t.Run("Rolling back without a previous snapshot fails", func(t *testing.T) {
+		assert.Error(t, store.Rollback(ctx))
+	})
+
+	require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 1, Type: "story", By: "alice", Score: 1}))
+	require.NoError(t, store.SaveItem(ctx, &scraper.ItemResponse{ID: 2, Type: "comment", By: "bob", Parent: 1}))
+	require.NoError(t, store.SaveFeed(ctx, scraper.FeedTop, []int{1}))
+	require.NoError(t, store.SaveMaxItem(ctx, 2))
+
+	snapshot, err := store.Snapshot(ctx)
+	require.NoError(t, err)
+	require.NoError(t, snapshot.SaveItem(ctx, &scraper.ItemResponse{ID: 1, Type: "story", By: "alice", Score: 5}))
+	require.NoError(t, snapshot.DeleteItem(ctx, &scraper.ItemResponse{ID: 2, Deleted: true}))
+	require.NoError(t, snapshot.SaveItem(ctx, &scraper.ItemResponse{ID: 3, Type: "story", By: "carol"}))
+	require.NoError(t, snapshot.SaveFeed(ctx, scraper.FeedTop, []int{3, 1}))
+	require.NoError(t, snapshot.SaveUser(ctx, &scraper.UserResponse{ID: "carol"}))
+	require.NoError(t, snapshot.SaveMaxItem(ctx, 3))
+	require.NoError(t, snapshot.SaveLastScrape(ctx, time.Unix(1612325106, 0)))
+
+	assertLive := func(t *testing.T, items []int, top []int, score int, maxItem int) {
+		result, err := store.GetAllItems(ctx, server.ListQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, items, result.IDs)
+
+		result, err = store.GetTopStories(ctx, server.ListQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, top, result.IDs)
+
+		item, err := store.GetItem(ctx, 1)
+		require.NoError(t, err)
+		assert.Equal(t, score, item.Score)
+
+		lastMaxItem, err := store.LastMaxItem(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, maxItem, lastMaxItem)
+	}
+
+	t.Run("Staged writes are not visible until committed", func(t *testing.T) {
+		assertLive(t, []int{1, 2}, []int{1}, 1, 2)
+
+		lastMaxItem, err := snapshot.LastMaxItem(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 3, lastMaxItem)
+
+		status, err := store.Status(ctx)
+		require.NoError(t, err)
+		assert.True(t, status.LastScrape.IsZero())
+	})
+
+	t.Run("Committing publishes every staged write", func(t *testing.T) {
+		calls := 0
+		generate := func(ctx context.Context) (interface{}, error) {
+			calls++
+			return calls, nil
+		}
+
+		var value int
+		require.NoError(t, store.Cache(ctx, "snapshot", time.Minute, &value, generate))
+		require.NoError(t, snapshot.Commit(ctx))
+		require.NoError(t, store.Cache(ctx, "snapshot", time.Minute, &value, generate))
+		assert.Equal(t, 2, value)
+
+		assertLive(t, []int{1, 3}, []int{3, 1}, 5, 3)
+
+		item, err := store.GetItem(ctx, 2)
+		require.NoError(t, err)
+		assert.Equal(t, &scraper.ItemResponse{ID: 2, Parent: 1, Deleted: true}, item)
+
+		result, err := store.GetAllItems(ctx, server.ListQuery{By: "bob"})
+		require.NoError(t, err)
+		assert.Empty(t, result.IDs)
+
+		user, err := store.GetUser(ctx, "carol")
+		require.NoError(t, err)
+		assert.NotNil(t, user)
+
+		status, err := store.Status(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1612325106), status.LastScrape.Unix())
+	})
+
+	t.Run("Rolling back restores the previous data", func(t *testing.T) {
+		require.NoError(t, store.Rollback(ctx))
+
+		assertLive(t, []int{1, 2}, []int{1}, 1, 2)
+
+		item, err := store.GetItem(ctx, 3)
+		require.NoError(t, err)
+		assert.Nil(t, item)
+
+		user, err := store.GetUser(ctx, "carol")
+		require.NoError(t, err)
+		assert.Nil(t, user)
+
+		result, err := store.GetAllItems(ctx, server.ListQuery{By: "bob"})
+		require.NoError(t, err)
+		assert.Equal(t, []int{2}, result.IDs)
+
+		status, err := store.Status(ctx)
+		require.NoError(t, err)
+		assert.True(t, status.LastScrape.IsZero())
+	})
+
+	t.Run("Rolling back twice restores the snapshot", func(t *testing.T) {
+		require.NoError(t, store.Rollback(ctx))
+
+		assertLive(t, []int{1, 3}, []int{3, 1}, 5, 3)
+	})
+
+	t.Run("Discarded snapshots are never published", func(t *testing.T) {
+		discarded, err := store.Snapshot(ctx)
+		require.NoError(t, err)
+		require.NoError(t, discarded.SaveItem(ctx, &scraper.ItemResponse{ID: 4, Type: "story"}))
+		require.NoError(t, discarded.Discard(ctx))
+		require.NoError(t, discarded.Commit(ctx))
+
+		assertLive(t, []int{1, 3}, []int{3, 1}, 5, 3)
+
+		item, err := store.GetItem(ctx, 4)
+		require.NoError(t, err)
+		assert.Nil(t, item)
+	})
+}
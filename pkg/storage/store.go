@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jralph/hackernews-api/internal/scraper"
+	"github.com/jralph/hackernews-api/internal/server"
+)
+
+// Store is implemented by every storage backend, so any of them can be used
+// by both the scraper and the api.
+//
+// The methods below document the contract every store keeps, the comments on
+// each store only cover what differs.
+type Store interface {
+	scraper.Saver
+	scraper.Snapshotter
+	server.Storage
+
+	// SaveFeed replaces the ids of a feed, kept in ranked order.
+	SaveFeed(context.Context, scraper.Feed, []int) error
+
+	// GetFeed fetches a page of the ids in a feed, in ranked order.
+	GetFeed(context.Context, scraper.Feed, server.ListQuery) (server.ListResult, error)
+
+	// DeleteItem removes an item from the indexes and replaces it with a
+	// tombstone, so that it can be reported as gone rather than never having
+	// existed.
+	DeleteItem(context.Context, *scraper.ItemResponse) error
+
+	// SaveLastScrape records when a scrape finished and invalidates the cached
+	// responses, so the writes of a scrape are served all at once. No other
+	// write invalidates the cache.
+	SaveLastScrape(context.Context, time.Time) error
+
+	// GetItems fetches several items at once. The returned items are in the
+	// same order as ids, with nil in place of any items that are not stored.
+	GetItems(context.Context, []int) ([]*scraper.ItemResponse, error)
+
+	// Status reports when the scraper last finished and how many items of
+	// each type are stored.
+	Status(context.Context) (server.StoreStatus, error)
+
+	// Cache fills target with the value cached under key, generating and
+	// caching it with f for duration if missing, or if a scrape has finished
+	// since it was cached. Concurrent misses for the same key are coalesced,
+	// so each value is only generated once. When a stale period has been set
+	// with WithStaleWhileRevalidate, expired values continue to be served for
+	// that period while one caller regenerates them in the background, unless
+	// a scrape has finished since they were cached.
+	Cache(context.Context, string, time.Duration, interface{}, func(context.Context) (interface{}, error)) error
+
+	// Snapshot starts staging writes, which are only visible to readers once
+	// the returned snapshot is committed. Staged deletes only look up the item
+	// they replace on commit, and LastMaxItem returns the staged max item if
+	// one has been saved. Committing keeps the data the snapshot replaces so
+	// that it can be restored with Rollback, while discarding throws away the
+	// staged writes.
+	Snapshot(context.Context) (scraper.Snapshot, error)
+
+	// Rollback restores the data replaced by the last committed snapshot. The
+	// data it replaces is kept in turn, so rolling back twice restores the
+	// snapshot again.
+	Rollback(context.Context) error
+
+	// Close releases the connections or files held by the store.
+	Close() error
+}
+
+// options are shared by every store. Options that do not apply to a store,
+// such as the redis client for the in-memory store, are ignored by it.
+type options struct {
+	client    redis.UniversalClient
+	metrics   *metrics
+	staleFor  time.Duration
+	cacheSize int
+}
+
+type Option func(*options)
+
+func newOptions(opts ...Option) *options {
+	o := &options{
+		metrics:   newMetrics(),
+		cacheSize: defaultCacheSize,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// WithStaleWhileRevalidate keeps cached values for staleFor after they
+// expire, serving them while they are regenerated in the background. Values
+// built before the last scrape finished are never served stale.
+func WithStaleWhileRevalidate(staleFor time.Duration) Option {
+	return func(o *options) {
+		o.staleFor = staleFor
+	}
+}
+
+// WithCacheSize limits the number of values cached by the stores that cache in
+// process, dropping the least recently used values once it is reached. It is
+// ignored by redis, which expires values itself.
+func WithCacheSize(entries int) Option {
+	return func(o *options) {
+		o.cacheSize = entries
+	}
+}
+
+// changeSet is a set of changes to the stored data. A nil item or user marks
+// it as not existing, so applying the change removes it.
+type changeSet struct {
+	items      map[int][]byte
+	users      map[string][]byte
+	feeds      map[scraper.Feed][]int
+	maxItem    *int
+	lastScrape *int64
+}
+
+func newChangeSet() *changeSet {
+	return &changeSet{
+		items: map[int][]byte{},
+		users: map[string][]byte{},
+		feeds: map[scraper.Feed][]int{},
+	}
+}
+
+func (c *changeSet) empty() bool {
+	return len(c.items) == 0 && len(c.users) == 0 && len(c.feeds) == 0 && c.maxItem == nil && c.lastScrape == nil
+}